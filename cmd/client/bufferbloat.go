@@ -0,0 +1,194 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	pingInterval  = 100 * time.Millisecond
+	idlePingCount = 20
+	// loadWarmup skips the slow start of the load before pinging
+	loadWarmup = time.Second
+	// defaultLoadDuration is used when no -duration is given
+	defaultLoadDuration = 10 * time.Second
+)
+
+// pinger measures round trips with WebSocket messages echoed by
+// /api/ping/ws. It uses its own connection, so under load the pings queue
+// behind the test traffic in the same bottleneck buffer.
+type pinger struct {
+	ws *websocket.Conn
+}
+
+func dialPinger(baseUrl *url.URL) (*pinger, error) {
+	wsUrl := endpointUrl(baseUrl, "ping/ws")
+	wsUrl.RawQuery = ""
+	origin := url.URL{Scheme: wsUrl.Scheme, Host: wsUrl.Host}
+	switch wsUrl.Scheme {
+	case "https":
+		wsUrl.Scheme = "wss"
+	default:
+		wsUrl.Scheme = "ws"
+	}
+
+	config, err := websocket.NewConfig(wsUrl.String(), origin.String())
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	ws, err := websocket.DialConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &pinger{ws: ws}, nil
+}
+
+func (p *pinger) Ping() (time.Duration, error) {
+	start := time.Now()
+	msg := strconv.FormatInt(start.UnixNano(), 10)
+	if err := websocket.Message.Send(p.ws, msg); err != nil {
+		return 0, err
+	}
+	var echo string
+	if err := websocket.Message.Receive(p.ws, &echo); err != nil {
+		return 0, err
+	}
+	if echo != msg {
+		return 0, errors.New("unexpected ping echo")
+	}
+	return time.Since(start), nil
+}
+
+// pingUntil pings every pingInterval until done is closed, or count times
+// if count is positive.
+func (p *pinger) pingUntil(done <-chan struct{}, count int) []time.Duration {
+	var rtts []time.Duration
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for count <= 0 || len(rtts) < count {
+		rtt, err := p.Ping()
+		if err != nil {
+			log.Printf("ping failed: %+v", err)
+			return rtts
+		}
+		rtts = append(rtts, rtt)
+		select {
+		case <-done:
+			return rtts
+		case <-ticker.C:
+		}
+	}
+	return rtts
+}
+
+func (p *pinger) Close() error {
+	return p.ws.Close()
+}
+
+// runBufferbloat measures the idle latency and the latency while a download
+// and then an upload saturate the link.
+func runBufferbloat(client *http.Client, baseUrl *url.URL, params *TestParams) {
+	p, err := dialPinger(baseUrl)
+	if err != nil {
+		log.Fatalf("ping connection failed: %+v", err)
+		return
+	}
+	defer p.Close()
+
+	loadParams := *params
+	if loadParams.Duration <= 0 && loadParams.Size == "" {
+		loadParams.Duration = defaultLoadDuration
+	}
+
+	log.Printf("Measuring idle latency")
+	idle := p.pingUntil(nil, idlePingCount)
+
+	loaded := func(name string, measure func(*http.Client, *url.URL, *TestParams) (float64, RawJson), u *url.URL) []time.Duration {
+		log.Printf("Measuring latency during %s", name)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			measure(client, u, &loadParams)
+		}()
+		select {
+		case <-time.After(loadWarmup):
+		case <-done:
+		}
+		rtts := p.pingUntil(done, 0)
+		<-done
+		return rtts
+	}
+	download := loaded("download", httpGetAndMeasureSpeed, baseUrl)
+	upload := loaded("upload", httpPostAndMeasureSpeed, endpointUrl(baseUrl, "uploading"))
+
+	log.Printf("Latency Under Load:")
+	idleMedian := percentile(idle, 50)
+	fmt.Printf("\tidle:     %s\n", formatRtts(idle))
+	for _, phase := range []struct {
+		name string
+		rtts []time.Duration
+	}{{"download", download}, {"upload", upload}} {
+		if len(phase.rtts) == 0 {
+			fmt.Printf("\t%-9s no samples\n", phase.name+":")
+			continue
+		}
+		increase := percentile(phase.rtts, 50) - idleMedian
+		fmt.Printf("\t%-9s %s  %+.1f ms  grade %s\n", phase.name+":", formatRtts(phase.rtts),
+			float64(increase.Microseconds())/1000, bufferbloatGrade(increase))
+	}
+}
+
+// bufferbloatGrade grades the increase of the median latency under load.
+func bufferbloatGrade(increase time.Duration) string {
+	switch {
+	case increase < 5*time.Millisecond:
+		return "A+"
+	case increase < 30*time.Millisecond:
+		return "A"
+	case increase < 60*time.Millisecond:
+		return "B"
+	case increase < 200*time.Millisecond:
+		return "C"
+	case increase < 400*time.Millisecond:
+		return "D"
+	default:
+		return "F"
+	}
+}
+
+func percentile[T cmp.Ordered](values []T, p int) T {
+	if len(values) == 0 {
+		var zero T
+		return zero
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func formatRtts(rtts []time.Duration) string {
+	ms := func(d time.Duration) float64 {
+		return float64(d.Microseconds()) / 1000
+	}
+	return fmt.Sprintf("median %7.1f ms  p90 %7.1f ms  (%d pings)",
+		ms(percentile(rtts, 50)), ms(percentile(rtts, 90)), len(rtts))
+}
+
+// endpointUrl returns the url of another /api endpoint next to baseUrl,
+// keeping the query.
+func endpointUrl(baseUrl *url.URL, name string) *url.URL {
+	u := *baseUrl
+	u.Path = path.Join(path.Dir(u.Path), name)
+	return &u
+}
@@ -2,94 +2,59 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/footer"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
 	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/udpprobe"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/units"
 	"io"
 	"log"
 	"math/rand"
+	randv2 "math/rand/v2"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 )
 
-type TCPInfoV0 struct {
-	State             uint32
-	Mss               uint32
-	ConnectionTimeMs  uint64
-	TimestampsEnabled bool
-	RttUs             uint32
-	MinRttUs          uint32
-	BytesInFlight     uint32
-	Cwnd              uint32
-	SndWnd            uint32
-	RcvWnd            uint32
-	RcvBuf            uint32
-	BytesOut          uint64
-	BytesIn           uint64
-	BytesReordered    uint32
-	BytesRetrans      uint32
-	FastRetrans       uint32
-	DupAcksIn         uint32
-	TimeoutEpisodes   uint32
-	SynRetrans        uint8
-}
-
 type RawJson = map[string]interface{}
 
-func consumeBuffer(r io.Reader) (int, RawJson, error) {
+// resultTrailer is the HTTP trailer the server puts the result into when the
+// download is requested with result=trailer.
+const resultTrailer = "X-Test-Result"
+
+// consumeBuffer reads the body to the end. With parseFooter the result JSON
+// is decoded from the footer at the end of the body. The payload, without
+// the footer, is fed to verifier when it is not nil.
+func consumeBuffer(r io.Reader, parseFooter bool, verifier *payload.Verifier) (int, RawJson, error) {
 	var tcpInfo RawJson
 
-	var buffer [4096]byte
+	var buffer [32 * 1024]byte
 	var totalBytes int
-	var lastChunk []byte // 마지막 청크를 저장할 변수
+	var tail footer.TailBuffer
+	if verifier != nil {
+		tail.Out = verifier
+	}
 
 	for {
 		n, err := r.Read(buffer[:])
 		totalBytes += n
-
-		// 마지막 4KB를 유지
-		if len(lastChunk)+n > 4096 {
-			lastChunk = append(lastChunk[len(lastChunk)+n-4096:], buffer[:n]...)
-		} else {
-			lastChunk = append(lastChunk, buffer[:n]...)
+		if parseFooter {
+			_, _ = tail.Write(buffer[:n])
+		} else if verifier != nil {
+			_, _ = verifier.Write(buffer[:n])
 		}
 
 		if err != nil {
 			if err == io.EOF {
-				// JSON 데이터 추출
-				if len(lastChunk) > 0 {
-					// JSON 시작 위치 찾기 ('{' 문자)
-					jsonStartIndex := -1
-					for i, b := range lastChunk {
-						if b == '{' {
-							jsonStartIndex = i
-							break
-						}
-					}
-
-					// JSON 끝 위치 찾기 (첫 번째 null 바이트)
-					jsonEndIndex := -1
-					if jsonStartIndex != -1 {
-						for i := jsonStartIndex; i < len(lastChunk); i++ {
-							if lastChunk[i] == 0 {
-								jsonEndIndex = i
-								break
-							}
-						}
-					}
-
-					// JSON 파싱
-					if jsonStartIndex != -1 && jsonEndIndex != -1 {
-						jsonData := lastChunk[jsonStartIndex:jsonEndIndex]
-						if err := json.Unmarshal(jsonData, &tcpInfo); err != nil {
-							log.Printf("json unmarshal failed: %+v", err)
-						}
-					}
-				}
 				break
 			}
 			log.Printf("Error reading response body: %+v", err)
@@ -97,16 +62,71 @@ func consumeBuffer(r io.Reader) (int, RawJson, error) {
 		}
 	}
 
+	if parseFooter {
+		payload, err := tail.Flush()
+		if err != nil {
+			log.Printf("footer decode failed: %+v", err)
+		} else if err := json.Unmarshal(payload, &tcpInfo); err != nil {
+			log.Printf("json unmarshal failed: %+v", err)
+		}
+	}
+
 	return totalBytes, tcpInfo, nil
 }
 
 type StatCtx struct {
-	TCPInfoV0 interface{}
+	TCPInfo *tcpinfo.Info
+	Samples []tcpinfo.Sample
+	// conns counts the wrapped connections that have not been closed yet;
+	// the HTTP transport closes them on its own goroutine after the body
+	conns sync.WaitGroup
 }
 
-func httpGetAndMeasureSpeed(client *http.Client, baseUrl *url.URL) float64 {
+// TestParams are the options shared by download and upload tests.
+type TestParams struct {
+	SampleInterval time.Duration
+	ResultMode     string
+	// Size is passed to the server as is (e.g. "64M"), Duration bounds the
+	// test by time instead of size
+	Size     string
+	Duration time.Duration
+	// Pattern is the download payload pattern, empty for the server default
+	Pattern string
+	// Seed requests the reproducible stream of the seed, which the
+	// receiving side verifies
+	Seed string
+	// BufferSize is the size of each read and write of raw TCP tests
+	BufferSize string
+}
+
+func (p *TestParams) query(baseUrl *url.URL) url.URL {
 	var targetUrl url.URL = *baseUrl
-	targetUrl.Query().Set("n", fmt.Sprintf("%f", rand.Float32()))
+	query := targetUrl.Query()
+	query.Set("n", fmt.Sprintf("%f", rand.Float32()))
+	if p.SampleInterval > 0 {
+		query.Set("sample", p.SampleInterval.String())
+	}
+	if p.Size != "" {
+		query.Set("size", p.Size)
+	}
+	if p.Duration > 0 {
+		query.Set("duration", p.Duration.String())
+	}
+	if p.Pattern != "" {
+		query.Set("pattern", p.Pattern)
+	}
+	if p.Seed != "" {
+		query.Set("seed", p.Seed)
+	}
+	targetUrl.RawQuery = query.Encode()
+	return targetUrl
+}
+
+func httpGetAndMeasureSpeed(client *http.Client, baseUrl *url.URL, params *TestParams) (float64, RawJson) {
+	targetUrl := params.query(baseUrl)
+	query := targetUrl.Query()
+	query.Set("result", params.ResultMode)
+	targetUrl.RawQuery = query.Encode()
 
 	stat := &StatCtx{}
 	ctx := context.WithValue(context.Background(), "stat", stat)
@@ -115,13 +135,30 @@ func httpGetAndMeasureSpeed(client *http.Client, baseUrl *url.URL) float64 {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Fatalf("HTTP Get failed: %+v", err)
-		return -1
+		return -1, nil
+	}
+
+	// a server that declared the trailer sends a pure payload, anything else
+	// (older servers, result=footer) appends the footer
+	_, trailerMode := resp.Trailer[resultTrailer]
+
+	var verifier *payload.Verifier
+	if params.Seed != "" {
+		verifier = payload.NewVerifier(params.Seed)
 	}
 
 	startTime := time.Now()
-	totalBytes, jsonOut, err := consumeBuffer(resp.Body)
+	totalBytes, jsonOut, err := consumeBuffer(resp.Body, !trailerMode, verifier)
 	elapsedTime := time.Since(startTime).Seconds()
 
+	if trailerMode {
+		if value := resp.Trailer.Get(resultTrailer); value != "" {
+			if err := json.Unmarshal([]byte(value), &jsonOut); err != nil {
+				log.Printf("json unmarshal failed: %+v", err)
+			}
+		}
+	}
+
 	// 초당 비트 수(bps) 계산
 	bps := float64(totalBytes*8) / elapsedTime
 
@@ -130,22 +167,261 @@ func httpGetAndMeasureSpeed(client *http.Client, baseUrl *url.URL) float64 {
 
 	_ = resp.Body.Close()
 
+	if verifier != nil {
+		size := int64(-1)
+		if query.Get("duration") == "" {
+			size = 16 * units.MiB
+			if n, err := units.ParseSize(query.Get("size"), units.MiB); err == nil {
+				size = n
+			}
+		}
+		printIntegrity(verifier.Integrity(expectedBytes(jsonOut, size)), jsonOut)
+	}
+	printResult(jsonOut, stat, bps)
+
+	return bps, jsonOut
+}
+
+// httpPostAndMeasureSpeed streams random data to the upload endpoint until
+// the size is sent or the duration has passed.
+func httpPostAndMeasureSpeed(client *http.Client, baseUrl *url.URL, params *TestParams) (float64, RawJson) {
+	targetUrl := params.query(baseUrl)
+
+	var size int64 = -1
+	if params.Size != "" {
+		n, err := units.ParseSize(params.Size, units.MiB)
+		if err != nil {
+			log.Fatalf("invalid size: %+v", err)
+			return -1, nil
+		}
+		size = n
+	} else if params.Duration <= 0 {
+		size = 16 * units.MiB
+	}
+
+	stat := &StatCtx{}
+	ctx := context.WithValue(context.Background(), "stat", stat)
+
+	body := newUploadBody(size, params.Duration, params.Seed)
+	req, _ := http.NewRequestWithContext(ctx, "POST", targetUrl.String(), body)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		req.ContentLength = size
+	}
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Fatalf("HTTP Post failed: %+v", err)
+		return -1, nil
+	}
+	var jsonOut RawJson
+	if err := json.NewDecoder(resp.Body).Decode(&jsonOut); err != nil {
+		log.Printf("json unmarshal failed: %+v", err)
+	}
+	elapsedTime := time.Since(startTime).Seconds()
+	_ = resp.Body.Close()
+
+	bps := float64(body.sent*8) / elapsedTime
+
+	log.Printf("Upload speed: %.2f Mbps (%d bytes in %.2f seconds)",
+		bps/1000000, body.sent, elapsedTime)
+
+	// the client side rate includes the request setup and the response, the
+	// server measures from the first to the last byte it received
+	if serverBps, ok := jsonOut["throughput"].(float64); ok && serverBps > 0 {
+		bps = serverBps
+		log.Printf("Upload speed (server measured): %.2f Mbps", bps/1000000)
+		printIntervals(jsonOut)
+	}
+	if body.hasher != nil {
+		printIntegrity(body.hasher.Integrity(), jsonOut)
+	}
+
+	printResult(jsonOut, stat, bps)
+
+	return bps, jsonOut
+}
+
+// expectedBytes is the length of a seeded download: the byte count the server
+// reports, otherwise size, the length that was requested (-1 if the test is
+// bounded by duration).
+func expectedBytes(jsonOut RawJson, size int64) int64 {
+	if integrity, ok := jsonOut["integrity"].(map[string]interface{}); ok {
+		if n, ok := integrity["bytes"].(float64); ok {
+			return int64(n)
+		}
+	}
+	return size
+}
+
+// printIntegrity compares the integrity of a seeded transfer seen by the
+// client with the one reported by the server. Whichever side received the
+// payload has verified it against the seeded stream.
+func printIntegrity(local *payload.Integrity, jsonOut RawJson) {
+	var remote payload.Integrity
+	if raw, ok := jsonOut["integrity"]; ok {
+		encoded, _ := json.Marshal(raw)
+		_ = json.Unmarshal(encoded, &remote)
+	}
+
+	log.Printf("Payload Integrity (seed=%s):", local.Seed)
+	fmt.Printf("\tclient: %d bytes sha256=%s\n", local.Bytes, local.Sha256)
+	if remote.Sha256 != "" {
+		fmt.Printf("\tserver: %d bytes sha256=%s\n", remote.Bytes, remote.Sha256)
+	} else {
+		fmt.Printf("\tserver: no integrity reported\n")
+	}
+
+	receiver, sender := local, &remote
+	if remote.Verified || remote.MismatchOffset != nil {
+		receiver, sender = &remote, local
+	}
+	switch {
+	case receiver.Truncated:
+		fmt.Printf("\t=> TRUNCATED: the stream ended at offset %d, before the end of the transfer\n", *receiver.MismatchOffset)
+	case sender.Sha256 != "" && receiver.MismatchOffset == nil && receiver.Bytes < sender.Bytes:
+		fmt.Printf("\t=> TRUNCATED: %d of the %d bytes sent were received\n", receiver.Bytes, sender.Bytes)
+	case receiver.MismatchOffset != nil:
+		fmt.Printf("\t=> CORRUPTED: the first byte that differs from the seeded stream is at offset %d\n", *receiver.MismatchOffset)
+	case !receiver.Verified:
+		fmt.Printf("\t=> not verified\n")
+	case remote.Sha256 != "" && remote.Sha256 != local.Sha256:
+		fmt.Printf("\t=> payload verified, but the hashes differ (client %d bytes, server %d bytes)\n",
+			local.Bytes, remote.Bytes)
+	default:
+		fmt.Printf("\t=> payload intact\n")
+	}
+}
+
+// printIntervals prints the per interval throughput measured by the server.
+func printIntervals(jsonOut RawJson) {
+	intervals, _ := jsonOut["intervals"].([]interface{})
+	for _, v := range intervals {
+		interval, _ := v.(map[string]interface{})
+		t, _ := interval["t"].(float64)
+		durationMs, _ := interval["durationMs"].(float64)
+		throughput, _ := interval["throughput"].(float64)
+		fmt.Printf("\t%6.0f ms +%4.0f ms %10.2f Mbps\n", t, durationMs, throughput/1000000)
+	}
+}
+
+// isServerCpuLimited reports whether the server flagged the test as CPU bound.
+func isServerCpuLimited(jsonOut RawJson) bool {
+	cpu, ok := jsonOut["cpu"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	limited, _ := cpu["limited"].(bool)
+	return limited
+}
+
+func printResult(jsonOut RawJson, stat *StatCtx, bps float64) {
 	if jsonOut != nil {
 		log.Printf("Server Side Result:")
 		raw, _ := json.MarshalIndent(jsonOut, "", "  ")
 		fmt.Println(string(raw))
 	}
+	// TCPInfo and Samples are filled in when the connection is closed
+	stat.conns.Wait()
 	log.Printf("Client Side Result:")
-	printStat(stat.TCPInfoV0)
+	printStat(stat.TCPInfo)
+	if len(stat.Samples) > 0 {
+		log.Printf("Client Side Samples:")
+		printSamples(stat.Samples)
+	}
+
+	if diagnosis := getServerDiagnosis(jsonOut); diagnosis != nil {
+		log.Printf("Server Side Diagnosis:")
+		printDiagnosis(diagnosis)
+	}
+	if stat.TCPInfo != nil {
+		log.Printf("Client Side Diagnosis:")
+		printDiagnosis(tcpinfo.Diagnose(stat.TCPInfo, stat.Samples, bps))
+	}
+}
 
-	return bps
+// uploadBody produces random data until size bytes are sent (size < 0 means
+// unlimited) or the duration since the first read has passed. With a seed
+// the data is the seeded stream the server verifies, and it is hashed.
+type uploadBody struct {
+	rnd      io.Reader
+	hasher   *payload.Hasher
+	size     int64
+	duration time.Duration
+	deadline time.Time
+	sent     int64
+}
+
+func newUploadBody(size int64, duration time.Duration, seed string) *uploadBody {
+	body := &uploadBody{
+		size:     size,
+		duration: duration,
+	}
+	if seed != "" {
+		body.rnd = payload.NewSeededReader(seed)
+		body.hasher = payload.NewHasher(seed)
+	} else {
+		var key [32]byte
+		_, _ = crand.Read(key[:])
+		body.rnd = randv2.NewChaCha8(key)
+	}
+	return body
+}
+
+func (u *uploadBody) Read(p []byte) (int, error) {
+	if u.deadline.IsZero() {
+		u.deadline = time.Now().Add(u.duration)
+	}
+	if u.duration > 0 && !time.Now().Before(u.deadline) {
+		return 0, io.EOF
+	}
+	if u.size >= 0 {
+		remain := u.size - u.sent
+		if remain <= 0 {
+			return 0, io.EOF
+		}
+		if remain < int64(len(p)) {
+			p = p[:remain]
+		}
+	}
+	n, _ := u.rnd.Read(p)
+	u.sent += int64(n)
+	if u.hasher != nil {
+		_, _ = u.hasher.Write(p[:n])
+	}
+	return n, nil
 }
 
 func main() {
 	var targetUrl string
 	var iteration int
+	var sampleInterval time.Duration
+	var resultMode string
+	var mode string
+	var size string
+	var duration time.Duration
+	var patternList string
+	var seed string
+	var bufferSize string
+	var bitrate string
+	var packetSize int
+	var streams int
 	flag.StringVar(&targetUrl, "url", "http://127.0.0.1:3000/api/downloading?size=1", "")
 	flag.IntVar(&iteration, "iter", 3, "")
+	flag.DurationVar(&sampleInterval, "sample", 0, "tcp info sampling interval (e.g. 50ms, 0 to disable)")
+	flag.StringVar(&resultMode, "result", "trailer", "how the server returns its result: trailer or footer")
+	flag.StringVar(&mode, "mode", "download", "download, upload, bufferbloat (latency under load) or udp (loss and jitter)")
+	flag.StringVar(&size, "size", "", "transfer size (e.g. 512K, 64M, 1G), overrides the size in the url")
+	flag.DurationVar(&duration, "duration", 0, "run each test for this long instead of a fixed size (e.g. 10s)")
+	flag.StringVar(&patternList, "pattern", "", "download payload pattern (random, zeros, text, dedup, json); "+
+		fmt.Sprintf("a comma separated list runs the patterns in turn, at least %d times each, and compares their median throughput", minPatternRounds))
+	flag.StringVar(&bufferSize, "buffer", "", "read/write size of raw TCP tests (e.g. 128K)")
+	flag.StringVar(&bitrate, "bitrate", "10M", "target bitrate of udp mode in bits/sec (e.g. 500k, 100M)")
+	flag.IntVar(&packetSize, "packet-size", udpprobe.DefaultPacketSize, "UDP payload size of udp mode")
+	flag.IntVar(&streams, "streams", 1, "download with this many concurrent streams, "+
+		"comparing one HTTP/2 connection (h2 or h2c) with as many HTTP/1.1 connections")
+	flag.StringVar(&seed, "seed", "", "send a reproducible payload derived from the seed and verify it on the receiving side")
 	flag.Parse()
 
 	parsedUrl, err := url.Parse(targetUrl)
@@ -154,6 +430,66 @@ func main() {
 		return
 	}
 
+	// tcp://host:port selects the raw TCP protocol instead of HTTP
+	raw := parsedUrl.Scheme == "tcp"
+	measure := httpGetAndMeasureSpeed
+	if raw {
+		measure = rawGetAndMeasureSpeed
+	}
+	switch mode {
+	case "download", "udp":
+	case "bufferbloat":
+		if raw {
+			log.Fatalf("bufferbloat mode needs an HTTP url")
+			return
+		}
+	case "upload":
+		if raw {
+			measure = rawPostAndMeasureSpeed
+			break
+		}
+		measure = httpPostAndMeasureSpeed
+		// the default url points at the download endpoint
+		parsedUrl = endpointUrl(parsedUrl, "uploading")
+	default:
+		log.Fatalf("invalid mode: %s", mode)
+		return
+	}
+	if patternList != "" && mode != "download" {
+		// the payload of every other mode is random, a comparison would
+		// measure the same thing under different names
+		log.Fatalf("payload patterns are only supported in download mode")
+		return
+	}
+
+	params := &TestParams{
+		SampleInterval: sampleInterval,
+		ResultMode:     resultMode,
+		Size:           size,
+		Duration:       duration,
+		Seed:           seed,
+		BufferSize:     bufferSize,
+	}
+
+	if streams > 1 {
+		if mode != "download" {
+			log.Fatalf("concurrent streams are only supported in download mode")
+			return
+		}
+		runStreams(parsedUrl, params, streams, iteration)
+		return
+	}
+
+	if mode == "udp" {
+		bps, err := units.ParseBitrate(bitrate)
+		if err != nil {
+			log.Fatalf("invalid bitrate: %+v", err)
+			return
+		}
+		runUdpTest(parsedUrl, params, bps, packetSize)
+		return
+	}
+
 	sysDialer := &net.Dialer{}
 	httpTransport := &http.Transport{
 		DisableKeepAlives: true,
@@ -178,6 +514,11 @@ func main() {
 				conn: tcpConn,
 				stat: stat.(*StatCtx),
 			}
+			wc.stat.conns.Add(1)
+			if sampleInterval > 0 {
+				wc.sampler = tcpinfo.NewSampler(wc, sampleInterval)
+				wc.sampler.Start()
+			}
 			log.Printf("TCP Connected to %+v", tcpConn.RemoteAddr())
 			return wc, nil
 		},
@@ -186,22 +527,128 @@ func main() {
 		Transport: httpTransport,
 	}
 
+	if mode == "bufferbloat" {
+		runBufferbloat(httpClient, parsedUrl, params)
+		return
+	}
+
+	patterns := strings.Split(patternList, ",")
+	if len(patterns) > 1 {
+		// random data is the baseline that nothing on the path can shrink
+		if !slices.Contains(patterns, string(payload.PatternRandom)) {
+			patterns = append([]string{string(payload.PatternRandom)}, patterns...)
+			log.Printf("comparing with %s, the incompressible baseline", payload.PatternRandom)
+		}
+		// the patterns take turns, so that a change of the path during the
+		// test affects all of them alike
+		rounds := max(iteration, minPatternRounds)
+		runs := make([][]float64, len(patterns))
+		cpuLimited := make([]bool, len(patterns))
+		for i := 0; i < rounds; i++ {
+			for p, pattern := range patterns {
+				params.Pattern = pattern
+				bps, jsonOut := measure(httpClient, parsedUrl, params)
+				if isServerCpuLimited(jsonOut) {
+					cpuLimited[p] = true
+				}
+				if bps > 0 {
+					runs[p] = append(runs[p], bps)
+				}
+				time.Sleep(time.Microsecond * 250)
+			}
+		}
+		comparePatterns(patterns, runs, cpuLimited)
+		return
+	}
+
+	params.Pattern = patternList
 	var total float64
 	for i := 0; i < iteration; i++ {
-		bps := httpGetAndMeasureSpeed(httpClient, parsedUrl)
+		bps, _ := measure(httpClient, parsedUrl, params)
 		if bps > 0 {
 			total += bps
 		}
 		time.Sleep(time.Microsecond * 250)
 	}
 	total /= float64(iteration)
+	if patternList != "" {
+		log.Printf("Average bps (pattern=%s): %f Mbps", patternList, total/1000000)
+	} else {
+		log.Printf("Average bps: %f Mbps", total/1000000)
+	}
+}
 
-	log.Printf("Average bps: %f Mbps", total/1000000)
+// patternSpeedup is how much faster than random data a compressible or
+// deduplicable pattern has to be before a middlebox is suspected.
+const patternSpeedup = 1.2
+
+// minPatternRounds is the least number of runs of every pattern in a
+// comparison, enough to see the run-to-run spread
+const minPatternRounds = 5
+
+// comparePatterns prints the median throughput of every pattern relative to
+// random data. Links do not care about the content of a payload, so a pattern
+// that is clearly faster is being compressed or deduplicated on the path.
+// Clearly means by patternSpeedup and beyond the spread of the runs: even the
+// slowest run of the pattern beat the fastest run of the baseline. patterns
+// must include random.
+func comparePatterns(patterns []string, runs [][]float64, cpuLimited []bool) {
+	baseline := slices.Index(patterns, string(payload.PatternRandom))
+
+	if len(runs[baseline]) == 0 {
+		log.Printf("no successful run of %s to compare with", patterns[baseline])
+		return
+	}
+	baselineMedian := percentile(runs[baseline], 50)
+	baselineMax := slices.Max(runs[baseline])
+
+	log.Printf("Throughput by pattern (median of the runs, relative to %s):", patterns[baseline])
+	var suspicious, withinSpread []string
+	for i, pattern := range patterns {
+		if len(runs[i]) == 0 {
+			fmt.Printf("\t%-8s no successful run\n", pattern)
+			continue
+		}
+		median := percentile(runs[i], 50)
+		ratio := median / baselineMedian
+		note := ""
+		if cpuLimited[i] {
+			note = "  (server cpu limited)"
+		}
+		fmt.Printf("\t%-8s %10.2f Mbps  x%.2f  (%d runs, %.2f - %.2f Mbps)%s\n",
+			pattern, median/1000000, ratio, len(runs[i]), slices.Min(runs[i])/1000000, slices.Max(runs[i])/1000000, note)
+		if i == baseline || ratio < patternSpeedup {
+			continue
+		}
+		if slices.Min(runs[i]) > baselineMax {
+			suspicious = append(suspicious, pattern)
+		} else {
+			withinSpread = append(withinSpread, pattern)
+		}
+	}
+
+	if len(withinSpread) > 0 {
+		fmt.Printf("\t   %s faster than %s, but within the run-to-run spread; run more iterations (-iter) to tell\n",
+			strings.Join(withinSpread, ", "), patterns[baseline])
+	}
+	if len(suspicious) > 0 {
+		fmt.Printf("\t=> %s faster than %s: a middlebox (WAN optimizer, compressing proxy) is likely compressing or deduplicating the traffic\n",
+			strings.Join(suspicious, ", "), patterns[baseline])
+		if cpuLimited[baseline] {
+			fmt.Printf("\t   but the server was cpu limited sending %s, so the difference may not come from the path\n", patterns[baseline])
+		}
+	} else if len(withinSpread) > 0 {
+		fmt.Printf("\t=> no difference beyond the run-to-run spread; no compressing or deduplicating middlebox detected\n")
+	} else {
+		fmt.Printf("\t=> throughput does not depend on the payload; no compressing or deduplicating middlebox detected\n")
+	}
 }
 
 type wrappedConn struct {
-	conn *net.TCPConn
-	stat *StatCtx
+	conn      *net.TCPConn
+	stat      *StatCtx
+	sampler   *tcpinfo.Sampler
+	closeOnce sync.Once
 }
 
 func (w *wrappedConn) Read(b []byte) (n int, err error) {
@@ -213,16 +660,27 @@ func (w *wrappedConn) Write(b []byte) (n int, err error) {
 }
 
 func (w *wrappedConn) Close() error {
-	info, err := tcpinfo.GetTcpInfo(w.conn)
-	if err != nil {
-		fmt.Println("TCP 정보 가져오기 실패:", err)
-	} else {
-		w.stat.TCPInfoV0 = info
-	}
+	w.closeOnce.Do(func() {
+		defer w.stat.conns.Done()
+		if w.sampler != nil {
+			w.stat.Samples = w.sampler.Stop()
+		}
+		info, err := tcpinfo.GetTcpInfo(w)
+		if err != nil {
+			fmt.Println("TCP 정보 가져오기 실패:", err)
+		} else {
+			w.stat.TCPInfo = info
+		}
+	})
 
 	return w.conn.Close()
 }
 
+// NetConn returns the underlying connection so that tcpinfo can reach the socket.
+func (w *wrappedConn) NetConn() net.Conn {
+	return w.conn
+}
+
 func (w *wrappedConn) LocalAddr() net.Addr {
 	return w.conn.LocalAddr()
 }
@@ -243,25 +701,85 @@ func (w *wrappedConn) SetWriteDeadline(t time.Time) error {
 	return w.conn.SetWriteDeadline(t)
 }
 
-func printStat(input interface{}) {
-	info := input.(*tcpinfo.TCPInfoV0)
-	// 재전송 관련 정보 출력
+func printStat(info *tcpinfo.Info) {
+	if info == nil {
+		fmt.Println("\tno tcp info")
+		return
+	}
+	// fields the kernel did not provide are printed as n/a instead of zero
+	value := func(field string, v interface{}) interface{} {
+		if !info.Supported(field) {
+			return "n/a"
+		}
+		return v
+	}
+	fmt.Printf("\tState: %s\n", info.State)
 	fmt.Printf("\tMSS: %d\n", info.Mss)
-	fmt.Printf("\tConnection Time: %d ms\n", info.ConnectionTimeMs)
-	fmt.Printf("\tTimestamps Enabled: %v\n", info.TimestampsEnabled)
-	fmt.Printf("\tRTT: %d  us\n", info.RttUs)
-	fmt.Printf("\tMin RTT: %d us\n", info.MinRttUs)
-	fmt.Printf("\tBytes In Flight: %d\n", info.BytesInFlight)
+	fmt.Printf("\tRTT: %d us\n", info.RttUs)
+	fmt.Printf("\tMin RTT: %v us\n", value("minRtt", info.MinRttUs))
 	fmt.Printf("\tCongestion Window (cwnd): %d\n", info.Cwnd)
-	fmt.Printf("\tSend Window (sndwnd): %d\n", info.SndWnd)
-	fmt.Printf("\tReceive Window (rcvwnd): %d\n", info.RcvWnd)
-	fmt.Printf("\tReceive Buffer (rcvbuf): %d\n", info.RcvBuf)
-	fmt.Printf("\tBytes Sent: %d\n", info.BytesOut)
-	fmt.Printf("\tBytes Received: %d\n", info.BytesIn)
-	fmt.Printf("\tBytes Reordered: %d\n", info.BytesReordered)
-	fmt.Printf("\tBytes Retransmitted: %d\n", info.BytesRetrans)
-	fmt.Printf("\tFast Retransmits: %d\n", info.FastRetrans)
-	fmt.Printf("\tDuplicate ACKs In: %d\n", info.DupAcksIn)
-	fmt.Printf("\tTimeout Episodes: %d\n", info.TimeoutEpisodes)
-	fmt.Printf("\tSYN Retransmits: %d\n", info.SynRetrans)
+	fmt.Printf("\tSend Window (sndwnd): %v\n", value("sndWnd", info.SndWnd))
+	fmt.Printf("\tReceive Window (rcvwnd): %v\n", value("rcvWnd", info.RcvWnd))
+	fmt.Printf("\tBytes Sent: %v\n", value("bytesOut", info.BytesOut))
+	fmt.Printf("\tBytes Received: %v\n", value("bytesIn", info.BytesIn))
+	fmt.Printf("\tBytes Retransmitted: %v\n", value("bytesRetrans", info.BytesRetrans))
+	fmt.Printf("\tRetransmits: %d\n", info.Retransmits)
+	fmt.Printf("\tRTO Timeouts: %v\n", value("timeouts", info.Timeouts))
+	printCongestion(info.Congestion)
+}
+
+func printCongestion(congestion *tcpinfo.CongestionInfo) {
+	if congestion == nil {
+		return
+	}
+	fmt.Printf("\tCongestion Control: %s\n", congestion.Name)
+	if bbr := congestion.Bbr; bbr != nil {
+		fmt.Printf("\t\tBBR Bottleneck Bandwidth: %.2f Mbps\n", float64(bbr.Bw*8)/1000000)
+		fmt.Printf("\t\tBBR Min RTT: %d us\n", bbr.MinRttUs)
+		fmt.Printf("\t\tBBR Pacing Gain: %.2f\n", float64(bbr.PacingGain)/256)
+		fmt.Printf("\t\tBBR Cwnd Gain: %.2f\n", float64(bbr.CwndGain)/256)
+	}
+	if dctcp := congestion.Dctcp; dctcp != nil {
+		fmt.Printf("\t\tDCTCP Enabled: %v\n", dctcp.Enabled)
+		fmt.Printf("\t\tDCTCP CE State: %d\n", dctcp.CeState)
+		fmt.Printf("\t\tDCTCP Alpha: %d\n", dctcp.Alpha)
+		fmt.Printf("\t\tDCTCP ECN Bytes: %d / %d\n", dctcp.AbEcn, dctcp.AbTot)
+	}
+	if vegas := congestion.Vegas; vegas != nil {
+		fmt.Printf("\t\tVegas Enabled: %v\n", vegas.Enabled)
+		fmt.Printf("\t\tVegas RTT Count: %d\n", vegas.RttCnt)
+		fmt.Printf("\t\tVegas RTT: %d us\n", vegas.RttUs)
+		fmt.Printf("\t\tVegas Min RTT: %d us\n", vegas.MinRttUs)
+	}
+}
+
+func getServerDiagnosis(jsonOut RawJson) *tcpinfo.Diagnosis {
+	raw, ok := jsonOut["diagnosis"]
+	if !ok {
+		return nil
+	}
+	encoded, _ := json.Marshal(raw)
+	diagnosis := &tcpinfo.Diagnosis{}
+	if err := json.Unmarshal(encoded, diagnosis); err != nil {
+		log.Printf("json unmarshal failed: %+v", err)
+		return nil
+	}
+	return diagnosis
+}
+
+func printDiagnosis(diagnosis *tcpinfo.Diagnosis) {
+	fmt.Printf("\tVerdict: %s\n", diagnosis.Verdict)
+	fmt.Printf("\t\t%s\n", diagnosis.Explanation)
+	for _, finding := range diagnosis.Findings[min(1, len(diagnosis.Findings)):] {
+		fmt.Printf("\tAlso: %s (severity %.2f)\n", finding.Bottleneck, finding.Severity)
+		fmt.Printf("\t\t%s\n", finding.Explanation)
+	}
+}
+
+func printSamples(samples []tcpinfo.Sample) {
+	fmt.Printf("\t%8s %10s %10s %10s %14s %8s %10s\n", "t(ms)", "cwnd", "rtt(us)", "rcvSpace", "deliveryRate", "retrans", "notsent")
+	for _, sample := range samples {
+		fmt.Printf("\t%8d %10d %10d %10d %14d %8d %10d\n",
+			sample.TimeMs, sample.Cwnd, sample.RttUs, sample.RcvSpace, sample.DeliveryRate, sample.Retransmits, sample.NotsentBytes)
+	}
 }
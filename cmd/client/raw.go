@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/json"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/rawtcp"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/sockopt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/units"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// rawGetAndMeasureSpeed and rawPostAndMeasureSpeed run the tests over the
+// raw TCP protocol for tcp://host:port urls. The query of the url takes the
+// size and the socket tuning parameters like the HTTP endpoints.
+func rawGetAndMeasureSpeed(_ *http.Client, baseUrl *url.URL, params *TestParams) (float64, RawJson) {
+	return rawMeasureSpeed(baseUrl, params, rawtcp.DirectionDownload)
+}
+
+func rawPostAndMeasureSpeed(_ *http.Client, baseUrl *url.URL, params *TestParams) (float64, RawJson) {
+	return rawMeasureSpeed(baseUrl, params, rawtcp.DirectionUpload)
+}
+
+func newRawRequest(baseUrl *url.URL, params *TestParams, direction rawtcp.Direction) (*rawtcp.Request, error) {
+	query := baseUrl.Query()
+	req := &rawtcp.Request{
+		Version:    rawtcp.Version,
+		Direction:  direction,
+		DurationMs: params.Duration.Milliseconds(),
+		SampleMs:   params.SampleInterval.Milliseconds(),
+		Pattern:    params.Pattern,
+		Seed:       params.Seed,
+	}
+
+	size := params.Size
+	if size == "" {
+		size = query.Get("size")
+	}
+	if size != "" {
+		n, err := units.ParseSize(size, units.MiB)
+		if err != nil {
+			return nil, err
+		}
+		req.Size = n
+	}
+	if params.BufferSize != "" {
+		n, err := units.ParseSize(params.BufferSize, 1)
+		if err != nil {
+			return nil, err
+		}
+		req.BufferSize = int(n)
+	}
+
+	tuning, errs := sockopt.ParseQuery(query)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	if !tuning.IsEmpty() {
+		req.Tuning = tuning
+	}
+	return req, nil
+}
+
+func rawMeasureSpeed(baseUrl *url.URL, params *TestParams, direction rawtcp.Direction) (float64, RawJson) {
+	req, err := newRawRequest(baseUrl, params, direction)
+	if err != nil {
+		log.Fatalf("invalid raw request: %+v", err)
+		return -1, nil
+	}
+
+	conn, err := net.Dial("tcp", baseUrl.Host)
+	if err != nil {
+		log.Fatalf("raw connect failed: %+v", err)
+		return -1, nil
+	}
+	defer conn.Close()
+	log.Printf("TCP Connected to %+v", conn.RemoteAddr())
+
+	stat := &StatCtx{}
+	var sampler *tcpinfo.Sampler
+	if params.SampleInterval > 0 {
+		sampler = tcpinfo.NewSampler(conn, params.SampleInterval)
+		sampler.Start()
+	}
+
+	reader := bufio.NewReader(conn)
+	var resp rawtcp.Response
+	if err := rawtcp.WriteLine(conn, req); err != nil {
+		log.Fatalf("raw request failed: %+v", err)
+		return -1, nil
+	}
+	if err := rawtcp.ReadLine(reader, &resp); err != nil {
+		log.Fatalf("raw response failed: %+v", err)
+		return -1, nil
+	}
+	if resp.Error != "" {
+		log.Fatalf("raw request rejected: %s", resp.Error)
+		return -1, nil
+	}
+
+	var bps float64
+	var jsonOut RawJson
+	var integrity *payload.Integrity
+	startTime := time.Now()
+	if direction == rawtcp.DirectionDownload {
+		var verifier *payload.Verifier
+		if params.Seed != "" {
+			verifier = payload.NewVerifier(params.Seed)
+		}
+		var totalBytes int
+		totalBytes, jsonOut, _ = consumeBuffer(reader, true, verifier)
+		elapsedTime := time.Since(startTime).Seconds()
+		bps = float64(totalBytes*8) / elapsedTime
+		log.Printf("Download speed: %.2f Mbps (%d bytes in %.2f seconds)", bps/1000000, totalBytes, elapsedTime)
+		if verifier != nil {
+			size := int64(-1)
+			if req.DurationMs <= 0 {
+				size = cmp.Or(req.Size, 16*units.MiB)
+			}
+			integrity = verifier.Integrity(expectedBytes(jsonOut, size))
+		}
+	} else {
+		bufferSize := req.BufferSize
+		if bufferSize <= 0 {
+			bufferSize = 128 * 1024
+		}
+		// the server reads until the half-close, size only bounds what is sent
+		var size int64 = -1
+		if req.Size > 0 {
+			size = req.Size
+		} else if req.DurationMs <= 0 {
+			size = 16 * units.MiB
+		}
+		body := newUploadBody(size, params.Duration, params.Seed)
+		buffer := make([]byte, bufferSize)
+		for {
+			n, err := body.Read(buffer)
+			if n > 0 {
+				if _, err := conn.Write(buffer[:n]); err != nil {
+					log.Printf("raw write failed: %+v", err)
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+		if err := json.NewDecoder(reader).Decode(&jsonOut); err != nil && err != io.EOF {
+			log.Printf("json unmarshal failed: %+v", err)
+		}
+		elapsedTime := time.Since(startTime).Seconds()
+		bps = float64(body.sent*8) / elapsedTime
+		log.Printf("Upload speed: %.2f Mbps (%d bytes in %.2f seconds)", bps/1000000, body.sent, elapsedTime)
+		if serverBps, ok := jsonOut["throughput"].(float64); ok && serverBps > 0 {
+			bps = serverBps
+			log.Printf("Upload speed (server measured): %.2f Mbps", bps/1000000)
+			printIntervals(jsonOut)
+		}
+		if body.hasher != nil {
+			integrity = body.hasher.Integrity()
+		}
+	}
+
+	if sampler != nil {
+		stat.Samples = sampler.Stop()
+	}
+	if info, err := tcpinfo.GetTcpInfo(conn); err != nil {
+		log.Printf("GetTcpInfo failed: %+v", err)
+	} else {
+		stat.TCPInfo = info
+	}
+
+	if integrity != nil {
+		printIntegrity(integrity, jsonOut)
+	}
+	printResult(jsonOut, stat, bps)
+	return bps, jsonOut
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// streamResult is one of the concurrent downloads of runStreams.
+type streamResult struct {
+	bytes   int
+	elapsed time.Duration
+	proto   string
+	connId  float64
+	// conn is the local address of the connection the stream used
+	conn string
+	err  error
+}
+
+func (s *streamResult) bps() float64 {
+	return float64(s.bytes*8) / s.elapsed.Seconds()
+}
+
+// runStreams downloads with n concurrent requests, over a single HTTP/2
+// connection and over n HTTP/1.1 connections, and compares the two. https
+// urls negotiate h2 with ALPN, http urls use h2c with prior knowledge.
+func runStreams(baseUrl *url.URL, params *TestParams, n int, iteration int) {
+	if baseUrl.Scheme != "http" && baseUrl.Scheme != "https" {
+		log.Fatalf("concurrent streams need an http or https url")
+		return
+	}
+
+	var h2Total, h1Total float64
+	for i := 0; i < iteration; i++ {
+		h2Total += measureStreams(baseUrl, params, n, true)
+		h1Total += measureStreams(baseUrl, params, n, false)
+		time.Sleep(time.Microsecond * 250)
+	}
+	h2Average := h2Total / float64(iteration)
+	h1Average := h1Total / float64(iteration)
+	log.Printf("Average of %d streams: HTTP/2 %.2f Mbps, HTTP/1.1 %.2f Mbps (x%.2f)",
+		n, h2Average/1000000, h1Average/1000000, h2Average/h1Average)
+}
+
+// newStreamsClient returns a client that speaks only HTTP/2 or only
+// HTTP/1.1.
+func newStreamsClient(http2 bool) *http.Client {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		Protocols: &http.Protocols{},
+	}
+	if http2 {
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	} else {
+		transport.Protocols.SetHTTP1(true)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// measureStreams runs n concurrent downloads and returns their aggregate
+// throughput. HTTP/2 shares one client, HTTP/1.1 gives every stream a client
+// of its own, so that a stream can not take over the connection another one
+// has finished with.
+func measureStreams(baseUrl *url.URL, params *TestParams, n int, http2 bool) float64 {
+	clients := make([]*http.Client, n)
+	for i := range clients {
+		if http2 && i > 0 {
+			clients[i] = clients[0]
+		} else {
+			clients[i] = newStreamsClient(http2)
+			defer clients[i].CloseIdleConnections()
+		}
+	}
+
+	// open the connections first, so that the HTTP/2 streams do not race to
+	// dial their own and no HTTP/1.1 stream starts late because of its dial
+	pingUrl := endpointUrl(baseUrl, "ping")
+	for i, client := range clients {
+		if http2 && i > 0 {
+			break
+		}
+		resp, err := client.Get(pingUrl.String())
+		if err != nil {
+			log.Fatalf("HTTP Get failed: %+v", err)
+			return -1
+		}
+		_ = resp.Body.Close()
+	}
+
+	results := make([]streamResult, n)
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			results[i] = downloadStream(clients[i], baseUrl, params)
+		}()
+	}
+	startTime := time.Now()
+	close(start)
+	wg.Wait()
+	elapsed := time.Since(startTime)
+
+	var total int
+	var minBps, maxBps, sum, sumSquares float64
+	connIds := make(map[float64]bool)
+	conns := make(map[string]bool)
+	proto := ""
+	for i, result := range results {
+		if result.err != nil {
+			log.Fatalf("stream %d failed: %+v", i, result.err)
+			return -1
+		}
+		bps := result.bps()
+		if i == 0 || bps < minBps {
+			minBps = bps
+		}
+		maxBps = max(maxBps, bps)
+		sum += bps
+		sumSquares += bps * bps
+		total += result.bytes
+		connIds[result.connId] = true
+		conns[result.conn] = true
+		proto = result.proto
+	}
+	bps := float64(total*8) / elapsed.Seconds()
+	// Jain's fairness index, 1 when every stream got the same share
+	fairness := sum * sum / (float64(n) * sumSquares)
+
+	label := "HTTP/1.1"
+	if http2 {
+		label = "HTTP/2"
+	}
+	if proto != label {
+		log.Printf("%s was requested but the server answered with %s", label, proto)
+	}
+	log.Printf("%s: %d streams over %d connection(s) (server saw %d): %.2f Mbps total, "+
+		"per stream %.2f - %.2f Mbps, fairness %.3f",
+		label, n, len(conns), len(connIds), bps/1000000, minBps/1000000, maxBps/1000000, fairness)
+	return bps
+}
+
+// downloadStream downloads once like httpGetAndMeasureSpeed without
+// printing the result.
+func downloadStream(client *http.Client, baseUrl *url.URL, params *TestParams) streamResult {
+	targetUrl := params.query(baseUrl)
+	query := targetUrl.Query()
+	query.Set("result", params.ResultMode)
+	targetUrl.RawQuery = query.Encode()
+
+	var conn string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn.LocalAddr().String()
+		},
+	}
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, targetUrl.String(), nil)
+	if err != nil {
+		return streamResult{err: err}
+	}
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return streamResult{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return streamResult{err: fmt.Errorf("status %s", resp.Status)}
+	}
+
+	_, trailerMode := resp.Trailer[resultTrailer]
+	totalBytes, jsonOut, err := consumeBuffer(resp.Body, !trailerMode, nil)
+	result := streamResult{
+		bytes:   totalBytes,
+		elapsed: time.Since(startTime),
+		proto:   fmt.Sprintf("HTTP/%d", resp.ProtoMajor),
+		conn:    conn,
+		err:     err,
+	}
+	if resp.ProtoMajor == 1 {
+		result.proto = "HTTP/1.1"
+	}
+	if trailerMode {
+		if value := resp.Trailer.Get(resultTrailer); value != "" {
+			if err := json.Unmarshal([]byte(value), &jsonOut); err != nil {
+				log.Printf("json unmarshal failed: %+v", err)
+			}
+		}
+	}
+	result.connId, _ = jsonOut["connId"].(float64)
+	return result
+}
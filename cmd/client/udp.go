@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/udpprobe"
+	"log"
+	randv2 "math/rand/v2"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultUdpDuration = 10 * time.Second
+	// udpPacingTick is how often the sender catches up with the target rate
+	udpPacingTick = time.Millisecond
+	udpEndRetries = 5
+	udpEndTimeout = time.Second
+)
+
+// runUdpTest sends datagrams to a udp://host:port url at a constant bitrate
+// and prints the loss, reordering and jitter the server observed. The
+// bitrate counts the UDP payload only.
+func runUdpTest(baseUrl *url.URL, params *TestParams, bitrate float64, packetSize int) {
+	if baseUrl.Scheme != "udp" {
+		log.Fatalf("udp mode needs a udp://host:port url")
+		return
+	}
+	if packetSize < udpprobe.HeaderSize || packetSize > udpprobe.MaxPacketSize {
+		log.Fatalf("packet size must be between %d and %d", udpprobe.HeaderSize, udpprobe.MaxPacketSize)
+		return
+	}
+	duration := params.Duration
+	if duration <= 0 {
+		duration = defaultUdpDuration
+	}
+
+	conn, err := net.Dial("udp", baseUrl.Host)
+	if err != nil {
+		log.Fatalf("udp dial failed: %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	session := randv2.Uint64()
+	packet := make([]byte, max(packetSize, udpprobe.EndSize))
+	packetsPerSecond := bitrate / float64(packetSize*8)
+	log.Printf("UDP test to %s: %.2f Mbps, %d byte packets for %v", conn.RemoteAddr(), bitrate/1000000, packetSize, duration)
+
+	var sent uint64
+	var sendErrors int
+	startTime := time.Now()
+	for elapsed := time.Duration(0); elapsed < duration; elapsed = time.Since(startTime) {
+		due := uint64(elapsed.Seconds() * packetsPerSecond)
+		for ; sent < due; sent++ {
+			// a sender that can not keep up still stops in time
+			now := time.Since(startTime)
+			if now >= duration {
+				break
+			}
+			header := &udpprobe.Header{
+				Type:     udpprobe.TypeData,
+				Session:  session,
+				Seq:      sent,
+				SendTime: now.Nanoseconds(),
+			}
+			header.Encode(packet)
+			// a full socket buffer or an ICMP error is loss like any other
+			if _, err := conn.Write(packet[:packetSize]); err != nil {
+				if sendErrors == 0 {
+					log.Printf("udp write failed: %+v", err)
+				}
+				sendErrors++
+			}
+		}
+		time.Sleep(udpPacingTick)
+	}
+	elapsed := time.Since(startTime).Seconds()
+	sentBps := float64(sent*uint64(packetSize)*8) / elapsed
+	log.Printf("UDP sent %d packets (%d bytes) in %.2f seconds, %.2f Mbps, %d send errors",
+		sent, sent*uint64(packetSize), elapsed, sentBps/1000000, sendErrors)
+
+	jsonOut, err := udpResult(conn, session, sent, packet[:udpprobe.EndSize])
+	if err != nil {
+		log.Fatalf("udp result failed: %+v", err)
+		return
+	}
+	printUdpResult(jsonOut)
+}
+
+// udpResult repeats the End packet until the server answers with its result.
+func udpResult(conn net.Conn, session uint64, sent uint64, packet []byte) (RawJson, error) {
+	for i := range packet {
+		packet[i] = 0
+	}
+	header := &udpprobe.Header{Type: udpprobe.TypeEnd, Session: session, Seq: sent}
+	header.Encode(packet)
+
+	buffer := make([]byte, udpprobe.MaxPacketSize)
+	for i := 0; i < udpEndRetries; i++ {
+		if _, err := conn.Write(packet); err != nil {
+			return nil, err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(udpEndTimeout))
+		for {
+			n, err := conn.Read(buffer)
+			if err != nil {
+				break
+			}
+			header, err := udpprobe.Decode(buffer[:n])
+			if err != nil || header.Type != udpprobe.TypeResult {
+				continue
+			}
+			var jsonOut RawJson
+			if err := json.Unmarshal(buffer[udpprobe.HeaderSize:n], &jsonOut); err != nil {
+				return nil, err
+			}
+			return jsonOut, nil
+		}
+	}
+	return nil, errors.New("no answer from the server")
+}
+
+func printUdpResult(jsonOut RawJson) {
+	log.Printf("Server Side Result:")
+	raw, _ := json.MarshalIndent(jsonOut, "", "  ")
+	log.Println(string(raw))
+
+	throughput, _ := jsonOut["throughput"].(float64)
+	lossPercent, _ := jsonOut["lossPercent"].(float64)
+	reordered, _ := jsonOut["reordered"].(float64)
+	duplicates, _ := jsonOut["duplicates"].(float64)
+	late, _ := jsonOut["late"].(float64)
+	jitterMs, _ := jsonOut["jitterMs"].(float64)
+	log.Printf("UDP received %.2f Mbps, loss %.3f%% (%d packets late), reordered %d, duplicates %d, jitter %.3f ms",
+		throughput/1000000, lossPercent, int64(late), int64(reordered), int64(duplicates), jitterMs)
+}
@@ -0,0 +1,44 @@
+package main
+
+import "time"
+
+// cpuLimitedThreshold is the CPU time per wall clock time above which a test
+// is considered CPU bound. A single transfer runs on one goroutine, so it can
+// not use much more than one core.
+const cpuLimitedThreshold = 0.9
+
+// cpuMeter measures the CPU time of the process during a test. The process
+// is shared by all tests, so concurrent tests inflate each other's usage.
+type cpuMeter struct {
+	start     time.Time
+	user, sys time.Duration
+	supported bool
+}
+
+func startCpuMeter() *cpuMeter {
+	m := &cpuMeter{start: time.Now()}
+	var err error
+	m.user, m.sys, err = processCpuTime()
+	m.supported = err == nil
+	return m
+}
+
+func (m *cpuMeter) Stop() *CpuJson {
+	if !m.supported {
+		return nil
+	}
+	elapsed := time.Since(m.start)
+	user, sys, err := processCpuTime()
+	if err != nil || elapsed <= 0 {
+		return nil
+	}
+	user -= m.user
+	sys -= m.sys
+	utilization := (user + sys).Seconds() / elapsed.Seconds()
+	return &CpuJson{
+		UserMs:      user.Milliseconds(),
+		SystemMs:    sys.Milliseconds(),
+		Utilization: utilization,
+		Limited:     utilization >= cpuLimitedThreshold,
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+func processCpuTime() (user time.Duration, sys time.Duration, err error) {
+	var creation, exit, kernel, userTime syscall.Filetime
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := syscall.GetProcessTimes(process, &creation, &exit, &kernel, &userTime); err != nil {
+		return 0, 0, err
+	}
+	return filetimeDuration(userTime), filetimeDuration(kernel), nil
+}
+
+// filetimeDuration converts a FILETIME holding a duration (100ns units).
+func filetimeDuration(ft syscall.Filetime) time.Duration {
+	return time.Duration(uint64(ft.HighDateTime)<<32|uint64(ft.LowDateTime)) * 100
+}
@@ -3,10 +3,38 @@ package main
 import (
 	"context"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
+var lastConnId atomic.Uint64
+
+// TcpCtx is attached to the context of every connection accepted by the TCP
+// listener. Id tells apart results of requests on the same connection, whose
+// TCP counters are cumulative. With HTTP/2 the requests of a connection run
+// concurrently and share all of it.
 type TcpCtx struct {
+	Id         uint64
 	NativeConn net.Conn
+	// Tls is set for connections of the HTTPS listener
+	Tls *TlsJson
+	// Active counts the requests in flight on the connection
+	Active atomic.Int32
+
+	mu     sync.Mutex
+	tuning *TuningJson
+}
+
+func (t *TcpCtx) Tuning() *TuningJson {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tuning
+}
+
+func (t *TcpCtx) SetTuning(tuning *TuningJson) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.tuning = tuning
 }
 
 func GetTcpCtx(ctx context.Context) *TcpCtx {
@@ -18,6 +46,21 @@ func GetTcpCtx(ctx context.Context) *TcpCtx {
 }
 
 func WithTcpCtx(ctx context.Context) (context.Context, *TcpCtx) {
-	v := &TcpCtx{}
+	v := &TcpCtx{
+		Id: lastConnId.Add(1),
+	}
 	return context.WithValue(ctx, "tcpCtx", v), v
 }
+
+func GetQuicCtx(ctx context.Context) *QuicCtx {
+	v, ok := ctx.Value("quicCtx").(*QuicCtx)
+	if ok {
+		return v
+	}
+	return nil
+}
+
+func WithQuicCtx(ctx context.Context) (context.Context, *QuicCtx) {
+	v := &QuicCtx{}
+	return context.WithValue(ctx, "quicCtx", v), v
+}
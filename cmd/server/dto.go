@@ -1,125 +1,221 @@
 package main
 
-import "golang.org/x/sys/unix"
+import (
+	"encoding/json"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/iperf3"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/sockopt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"time"
+)
 
+// TCPInfoJson is the normalized tcpinfo.Info with the platform specific
+// counters attached under "raw". Fields the kernel did not provide are
+// omitted instead of being reported as zero.
 type TCPInfoJson struct {
-	State                uint8  `json:"state"`
-	Ca_state             uint8  `json:"caState"`
-	Retransmits          uint8  `json:"retransmits"`
-	Probes               uint8  `json:"probes"`
-	Backoff              uint8  `json:"backoff"`
-	Options              uint8  `json:"options"`
-	Rto                  uint32 `json:"rto"`
-	Ato                  uint32 `json:"ato"`
-	Snd_mss              uint32 `json:"sndMss"`
-	Rcv_mss              uint32 `json:"rcvMss"`
-	Unacked              uint32 `json:"unacked"`
-	Sacked               uint32 `json:"sacked"`
-	Lost                 uint32 `json:"lost"`
-	Retrans              uint32 `json:"retrans"`
-	Fackets              uint32 `json:"fackets"`
-	Last_data_sent       uint32 `json:"lastDataSent"`
-	Last_ack_sent        uint32 `json:"lastAckSent"`
-	Last_data_recv       uint32 `json:"lastDataRecv"`
-	Last_ack_recv        uint32 `json:"lastAckRecv"`
-	Pmtu                 uint32 `json:"pmtu"`
-	Rcv_ssthresh         uint32 `json:"rcvSsthresh"`
-	Rtt                  uint32 `json:"rtt"`
-	Rttvar               uint32 `json:"rttvar"`
-	Snd_ssthresh         uint32 `json:"sndSsthresh"`
-	Snd_cwnd             uint32 `json:"sndCwnd"`
-	Advmss               uint32 `json:"advmss"`
-	Reordering           uint32 `json:"reordering"`
-	Rcv_rtt              uint32 `json:"rcvRtt"`
-	Rcv_space            uint32 `json:"rcvSpace"`
-	Total_retrans        uint32 `json:"totalRetrans"`
-	Pacing_rate          uint64 `json:"pacingRate"`
-	Max_pacing_rate      uint64 `json:"maxPacingRate"`
-	Bytes_acked          uint64 `json:"bytesAcked"`
-	Bytes_received       uint64 `json:"bytesReceived"`
-	Segs_out             uint32 `json:"segsOut"`
-	Segs_in              uint32 `json:"segsIn"`
-	Notsent_bytes        uint32 `json:"notsentBytes"`
-	Min_rtt              uint32 `json:"minRtt"`
-	Data_segs_in         uint32 `json:"dataSegsIn"`
-	Data_segs_out        uint32 `json:"dataSegsOut"`
-	Delivery_rate        uint64 `json:"deliveryRate"`
-	Busy_time            uint64 `json:"busyTime"`
-	Rwnd_limited         uint64 `json:"rwndLimited"`
-	Sndbuf_limited       uint64 `json:"sndbufLimited"`
-	Delivered            uint32 `json:"delivered"`
-	Delivered_ce         uint32 `json:"deliveredCe"`
-	Bytes_sent           uint64 `json:"bytesSent"`
-	Bytes_retrans        uint64 `json:"bytesRetrans"`
-	Dsack_dups           uint32 `json:"dsackDups"`
-	Reord_seen           uint32 `json:"reordSeen"`
-	Rcv_ooopack          uint32 `json:"rcvOoopack"`
-	Snd_wnd              uint32 `json:"sndWnd"`
-	Rcv_wnd              uint32 `json:"rcvWnd"`
-	Rehash               uint32 `json:"rehash"`
-	Total_rto            uint16 `json:"totalRto"`
-	Total_rto_recoveries uint16 `json:"totalRtoRecoveries"`
-	Total_rto_time       uint32 `json:"totalRtoTime"`
-}
-
-func NewTCPInfoJson(tcpInfo *unix.TCPInfo) *TCPInfoJson {
+	*tcpinfo.Info
+	Raw interface{} `json:"raw,omitempty"`
+}
+
+func NewTCPInfoJson(info *tcpinfo.Info) *TCPInfoJson {
 	return &TCPInfoJson{
-		State:                tcpInfo.State,
-		Ca_state:             tcpInfo.Ca_state,
-		Retransmits:          tcpInfo.Retransmits,
-		Probes:               tcpInfo.Probes,
-		Backoff:              tcpInfo.Backoff,
-		Options:              tcpInfo.Options,
-		Rto:                  tcpInfo.Rto,
-		Ato:                  tcpInfo.Ato,
-		Snd_mss:              tcpInfo.Snd_mss,
-		Rcv_mss:              tcpInfo.Rcv_mss,
-		Unacked:              tcpInfo.Unacked,
-		Sacked:               tcpInfo.Sacked,
-		Lost:                 tcpInfo.Lost,
-		Retrans:              tcpInfo.Retrans,
-		Fackets:              tcpInfo.Fackets,
-		Last_data_sent:       tcpInfo.Last_data_sent,
-		Last_ack_sent:        tcpInfo.Last_ack_sent,
-		Last_data_recv:       tcpInfo.Last_data_recv,
-		Last_ack_recv:        tcpInfo.Last_ack_recv,
-		Pmtu:                 tcpInfo.Pmtu,
-		Rcv_ssthresh:         tcpInfo.Rcv_ssthresh,
-		Rtt:                  tcpInfo.Rtt,
-		Rttvar:               tcpInfo.Rttvar,
-		Snd_ssthresh:         tcpInfo.Snd_ssthresh,
-		Snd_cwnd:             tcpInfo.Snd_cwnd,
-		Advmss:               tcpInfo.Advmss,
-		Reordering:           tcpInfo.Reordering,
-		Rcv_rtt:              tcpInfo.Rcv_rtt,
-		Rcv_space:            tcpInfo.Rcv_space,
-		Total_retrans:        tcpInfo.Total_retrans,
-		Pacing_rate:          tcpInfo.Pacing_rate,
-		Max_pacing_rate:      tcpInfo.Max_pacing_rate,
-		Bytes_acked:          tcpInfo.Bytes_acked,
-		Bytes_received:       tcpInfo.Bytes_received,
-		Segs_out:             tcpInfo.Segs_out,
-		Segs_in:              tcpInfo.Segs_in,
-		Notsent_bytes:        tcpInfo.Notsent_bytes,
-		Min_rtt:              tcpInfo.Min_rtt,
-		Data_segs_in:         tcpInfo.Data_segs_in,
-		Data_segs_out:        tcpInfo.Data_segs_out,
-		Delivery_rate:        tcpInfo.Delivery_rate,
-		Busy_time:            tcpInfo.Busy_time,
-		Rwnd_limited:         tcpInfo.Rwnd_limited,
-		Sndbuf_limited:       tcpInfo.Sndbuf_limited,
-		Delivered:            tcpInfo.Delivered,
-		Delivered_ce:         tcpInfo.Delivered_ce,
-		Bytes_sent:           tcpInfo.Bytes_sent,
-		Bytes_retrans:        tcpInfo.Bytes_retrans,
-		Dsack_dups:           tcpInfo.Dsack_dups,
-		Reord_seen:           tcpInfo.Reord_seen,
-		Rcv_ooopack:          tcpInfo.Rcv_ooopack,
-		Snd_wnd:              tcpInfo.Snd_wnd,
-		Rcv_wnd:              tcpInfo.Rcv_wnd,
-		Rehash:               tcpInfo.Rehash,
-		Total_rto:            tcpInfo.Total_rto,
-		Total_rto_recoveries: tcpInfo.Total_rto_recoveries,
-		Total_rto_time:       tcpInfo.Total_rto_time,
+		Info: info,
+		Raw:  newRawTCPInfoJson(info.Raw),
+	}
+}
+
+func (t *TCPInfoJson) MarshalJSON() ([]byte, error) {
+	encoded, err := json.Marshal(t.Info)
+	if err != nil {
+		return nil, err
 	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(encoded, &fields); err != nil {
+		return nil, err
+	}
+	for _, name := range t.Unsupported {
+		delete(fields, name)
+	}
+	if t.Raw != nil {
+		if fields["raw"], err = json.Marshal(t.Raw); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// ResultJson is the server side result of a single download or upload test.
+type ResultJson struct {
+	// Bytes is the payload transferred by this request in ElapsedMs,
+	// Throughput is in bits/sec
+	Bytes      int64   `json:"bytes"`
+	ElapsedMs  int64   `json:"elapsedMs"`
+	Throughput float64 `json:"throughput"`
+	// Protocol is the HTTP version the request went over (e.g. "HTTP/3.0")
+	Protocol string `json:"protocol,omitempty"`
+	// Pattern is the payload pattern of a download
+	Pattern payload.Pattern `json:"pattern,omitempty"`
+	// Cpu is the CPU usage of the server process during the transfer
+	Cpu      *CpuJson `json:"cpu,omitempty"`
+	Sendfile bool     `json:"sendfile,omitempty"`
+	// Timing and Intervals are measured by the server for uploads
+	Timing    *TimingJson    `json:"timing,omitempty"`
+	Intervals []IntervalJson `json:"intervals,omitempty"`
+	// Integrity is reported for seeded transfers: the hash of what was sent
+	// for downloads, the verification of what was received for uploads
+	Integrity *payload.Integrity `json:"integrity,omitempty"`
+
+	// ConnId identifies the TCP connection; counters in TcpInfo are cumulative
+	// over all requests of the same connection
+	ConnId uint64 `json:"connId,omitempty"`
+	// Streams is the number of requests in flight on the connection when
+	// the result was taken, more than one when HTTP/2 streams share it
+	Streams    int32              `json:"streams,omitempty"`
+	TcpInfo    *TCPInfoJson       `json:"tcpInfo,omitempty"`
+	Samples    []tcpinfo.Sample   `json:"samples,omitempty"`
+	Diagnosis  *tcpinfo.Diagnosis `json:"diagnosis,omitempty"`
+	Tuning     *TuningJson        `json:"tuning,omitempty"`
+	QuicInfo   *QuicInfoJson      `json:"quicInfo,omitempty"`
+	QuicConfig *QuicConfigJson    `json:"quicConfig,omitempty"`
+	Tls        *TlsJson           `json:"tls,omitempty"`
+}
+
+// CpuJson is the CPU time the server process used during a test.
+// Utilization is in cores; Limited means the test was most likely bound by
+// the server CPU rather than the network.
+type CpuJson struct {
+	UserMs      int64   `json:"userMs"`
+	SystemMs    int64   `json:"systemMs"`
+	Utilization float64 `json:"utilization"`
+	Limited     bool    `json:"limited"`
+}
+
+// TimingJson holds the arrival of the first and the last byte of an upload,
+// in milliseconds since the request was received.
+type TimingJson struct {
+	FirstByteMs float64 `json:"firstByteMs"`
+	LastByteMs  float64 `json:"lastByteMs"`
+}
+
+// IntervalJson is the throughput (bits/sec) of one interval of a transfer,
+// TimeMs is the start of the interval relative to the first byte.
+type IntervalJson struct {
+	TimeMs     int64   `json:"t"`
+	DurationMs int64   `json:"durationMs"`
+	Bytes      int64   `json:"bytes"`
+	Throughput float64 `json:"throughput"`
+}
+
+// PingJson is the response of /api/ping. ServerTime is in Unix nanoseconds.
+type PingJson struct {
+	ServerTime int64 `json:"serverTime"`
+}
+
+// TuningJson is the socket tuning requested for a test and the effective
+// values read back from the kernel.
+type TuningJson struct {
+	Requested *sockopt.Options `json:"requested"`
+	Effective *sockopt.Options `json:"effective,omitempty"`
+	Errors    []string         `json:"errors,omitempty"`
+}
+
+// IperfTestJson is the server side record of an iperf3 test. iperf3 clients
+// have no place for it, so it is only logged.
+type IperfTestJson struct {
+	Remote  string            `json:"remote"`
+	Params  *iperf3.Params    `json:"params"`
+	Cpu     *CpuJson          `json:"cpu,omitempty"`
+	Streams []IperfStreamJson `json:"streams"`
+	// Client is the result the client reported
+	Client *iperf3.Results `json:"client,omitempty"`
+}
+
+type IperfStreamJson struct {
+	Id         int                `json:"id"`
+	Bytes      int64              `json:"bytes"`
+	ElapsedMs  int64              `json:"elapsedMs"`
+	Throughput float64            `json:"throughput"`
+	TCPInfo    *TCPInfoJson       `json:"tcpInfo,omitempty"`
+	Tuning     *TuningJson        `json:"tuning,omitempty"`
+	Diagnosis  *tcpinfo.Diagnosis `json:"diagnosis,omitempty"`
+}
+
+// UdpResultJson is the server side result of a UDP test. Throughput is the
+// received rate between the first and the last packet. Late counts the
+// packets that arrived too far behind to be checked for duplicates; they are
+// neither received nor reordered, so they count as lost.
+type UdpResultJson struct {
+	Sent        int64   `json:"sent"`
+	Received    int64   `json:"received"`
+	Bytes       int64   `json:"bytes"`
+	Lost        int64   `json:"lost"`
+	LossPercent float64 `json:"lossPercent"`
+	Duplicates  int64   `json:"duplicates"`
+	Reordered   int64   `json:"reordered"`
+	Late        int64   `json:"late"`
+	JitterMs    float64 `json:"jitterMs"`
+	ElapsedMs   int64   `json:"elapsedMs"`
+	Throughput  float64 `json:"throughput"`
+}
+
+// TlsJson describes the TLS session of the connection of a test. The server
+// measures HandshakeMs: over TCP from accepting the connection, over QUIC
+// from the first packet, until the handshake completed.
+type TlsJson struct {
+	Version     string  `json:"version"`
+	CipherSuite string  `json:"cipherSuite"`
+	Alpn        string  `json:"alpn,omitempty"`
+	Resumed     bool    `json:"resumed,omitempty"`
+	HandshakeMs float64 `json:"handshakeMs"`
+}
+
+// CertHashJson is the hash of the server certificate in the form of a
+// WebTransport serverCertificateHashes entry, with the WebTransport
+// endpoint it is meant for. Browsers only accept the hash when Pinnable.
+type CertHashJson struct {
+	Algorithm string    `json:"algorithm"`
+	Value     string    `json:"value"`
+	NotAfter  time.Time `json:"notAfter"`
+	Pinnable  bool      `json:"pinnable"`
+	Port      int       `json:"port"`
+	Path      string    `json:"path"`
+}
+
+// QuicInfoJson is the QUIC equivalent of TCPInfoJson. Field names follow
+// tcpinfo.Info where both transports have the same metric; byte counters
+// include QUIC packet overhead.
+type QuicInfoJson struct {
+	Version       string `json:"version"`
+	RttUs         int64  `json:"rtt"`
+	MinRttUs      int64  `json:"minRtt"`
+	LatestRttUs   int64  `json:"latestRtt"`
+	RttVarUs      int64  `json:"rttVar"`
+	Cwnd          uint64 `json:"cwnd"`
+	BytesInFlight uint64 `json:"bytesInFlight"`
+	BytesIn       uint64 `json:"bytesIn"`
+	BytesOut      uint64 `json:"bytesOut"`
+	PacketsIn     uint64 `json:"packetsIn"`
+	PacketsOut    uint64 `json:"packetsOut"`
+	PacketsLost   uint64 `json:"packetsLost"`
+	Mtu           uint64 `json:"mtu"`
+	Used0Rtt      bool   `json:"used0Rtt,omitempty"`
+}
+
+// QuicConfigJson is the effective quic.Config of the HTTP/3 server, with the
+// quic-go defaults filled in. The receive windows only bound what the server
+// receives: downloads are limited by the windows of the client.
+type QuicConfigJson struct {
+	InitialStreamReceiveWindow     uint64 `json:"initialStreamReceiveWindow"`
+	MaxStreamReceiveWindow         uint64 `json:"maxStreamReceiveWindow"`
+	InitialConnectionReceiveWindow uint64 `json:"initialConnectionReceiveWindow"`
+	MaxConnectionReceiveWindow     uint64 `json:"maxConnectionReceiveWindow"`
+	MaxIncomingStreams             int64  `json:"maxIncomingStreams"`
+	MaxIncomingUniStreams          int64  `json:"maxIncomingUniStreams"`
+	MaxIdleTimeoutMs               int64  `json:"maxIdleTimeoutMs"`
+	HandshakeIdleTimeoutMs         int64  `json:"handshakeIdleTimeoutMs"`
+	KeepAlivePeriodMs              int64  `json:"keepAlivePeriodMs"`
+	InitialPacketSize              uint16 `json:"initialPacketSize"`
+	DisablePathMTUDiscovery        bool   `json:"disablePathMtuDiscovery"`
+	Allow0Rtt                      bool   `json:"allow0Rtt"`
+	EnableDatagrams                bool   `json:"enableDatagrams"`
 }
@@ -0,0 +1,5 @@
+package main
+
+func newRawTCPInfoJson(raw interface{}) interface{} {
+	return raw
+}
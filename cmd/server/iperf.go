@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/iperf3"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/sockopt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// iperfSetupTimeout bounds every step outside of the data transfer
+	iperfSetupTimeout     = 10 * time.Second
+	defaultIperfBlockSize = 128 * 1024
+)
+
+// iperfServer speaks the iperf3 protocol (see pkg/iperf3). Control and data
+// connections arrive on the same listener and are told apart by the cookie:
+// a data connection carries the cookie of a test that is creating streams.
+type iperfServer struct {
+	mu    sync.Mutex
+	tests map[string]*iperfTest
+}
+
+type iperfTest struct {
+	params iperf3.Params
+
+	mu      sync.Mutex
+	streams []*iperfStream
+	closed  bool
+	// ready is closed once all streams are connected
+	ready chan struct{}
+
+	// sent is the total of all streams in reverse mode
+	sent atomic.Int64
+}
+
+type iperfStream struct {
+	id   int
+	conn net.Conn
+	// bytes is counted from the start, omitted is the part sent or received
+	// during the omit period
+	bytes   atomic.Int64
+	omitted atomic.Int64
+	tuning  *TuningJson
+}
+
+func serveIperf(listener net.Listener) error {
+	s := &iperfServer{tests: make(map[string]*iperfTest)}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *iperfServer) handleConn(conn net.Conn) {
+	_ = conn.SetReadDeadline(time.Now().Add(iperfSetupTimeout))
+	cookie, err := iperf3.ReadCookie(conn)
+	if err != nil {
+		log.Printf("iperf3 cookie failed: %+v", err)
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	s.mu.Lock()
+	test := s.tests[cookie]
+	s.mu.Unlock()
+	if test != nil {
+		if !test.addStream(conn) {
+			_ = conn.Close()
+		}
+		return
+	}
+
+	defer conn.Close()
+	s.runTest(conn, cookie)
+}
+
+func (s *iperfServer) runTest(ctrl net.Conn, cookie string) {
+	remote := ctrl.RemoteAddr().String()
+	_ = ctrl.SetDeadline(time.Now().Add(iperfSetupTimeout))
+	if err := iperf3.WriteState(ctrl, iperf3.StateParamExchange); err != nil {
+		log.Printf("iperf3 write failed: %+v", err)
+		return
+	}
+	var params iperf3.Params
+	if err := iperf3.ReadJson(ctrl, &params); err != nil {
+		log.Printf("iperf3 parameters failed: %+v", err)
+		return
+	}
+	if errno, err := checkIperfParams(&params); err != nil {
+		log.Printf("iperf3 test from %s rejected: %v", remote, err)
+		_ = iperf3.WriteServerError(ctrl, errno)
+		return
+	}
+	pool, err := payloadPools.Get(payload.PatternRandom)
+	if err != nil {
+		log.Printf("payload pool failed: %+v", err)
+		return
+	}
+
+	test := &iperfTest{params: params, ready: make(chan struct{})}
+	s.mu.Lock()
+	s.tests[cookie] = test
+	s.mu.Unlock()
+
+	err = iperf3.WriteState(ctrl, iperf3.StateCreateStreams)
+	if err == nil {
+		select {
+		case <-test.ready:
+		case <-time.After(iperfSetupTimeout):
+			err = errors.New("streams were not created in time")
+		}
+	}
+	s.mu.Lock()
+	delete(s.tests, cookie)
+	s.mu.Unlock()
+	defer test.close()
+	if err != nil {
+		log.Printf("iperf3 create streams failed: %+v", err)
+		return
+	}
+
+	direction := "upload"
+	if params.Reverse {
+		direction = "download"
+	}
+	log.Printf("iperf3 %s test from %s: %d streams, %s", direction, remote, params.Parallel, params.ClientVersion)
+	for _, stream := range test.streams {
+		stream.tuning = applyIperfOptions(stream.conn, &params)
+	}
+
+	result, err := test.run(ctrl, pool)
+	if result != nil {
+		result.Remote = remote
+		encoded, _ := json.Marshal(result)
+		log.Printf("iperf3 result: %s", encoded)
+	}
+	if err != nil {
+		log.Printf("iperf3 test from %s failed: %+v", remote, err)
+	}
+}
+
+// checkIperfParams validates params and fills in the defaults. The error
+// number is what iperf3 itself would report.
+func checkIperfParams(params *iperf3.Params) (iperf3.Errno, error) {
+	if !params.Tcp || params.Udp || params.Sctp {
+		return iperf3.ErrnoUnimplemented, errors.New("only TCP tests are supported")
+	}
+	if params.Bidirectional {
+		return iperf3.ErrnoUnimplemented, errors.New("bidirectional tests are not supported")
+	}
+	if params.Parallel <= 0 {
+		params.Parallel = 1
+	}
+	if params.Parallel > iperf3.MaxStreams {
+		return iperf3.ErrnoNumStreams, fmt.Errorf("too many streams: %d", params.Parallel)
+	}
+	if params.Time < 0 || params.Omit < 0 || time.Duration(params.Time+params.Omit)*time.Second > maxTestDuration {
+		return iperf3.ErrnoDuration, fmt.Errorf("invalid duration: %ds", params.Time+params.Omit)
+	}
+	if params.Len == 0 {
+		params.Len = defaultIperfBlockSize
+	}
+	if params.Len < 0 || params.Len > payload.MaxChunkSize {
+		return iperf3.ErrnoBlockSize, fmt.Errorf("invalid block size: %d", params.Len)
+	}
+	return 0, nil
+}
+
+// applyIperfOptions maps the socket options of params to sockopt. Unlike
+// iperf3 they are set after the handshake, see applyTuning.
+func applyIperfOptions(conn net.Conn, params *iperf3.Params) *TuningJson {
+	// iperf3 leaves Nagle's algorithm on unless asked otherwise
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		_ = tcpConn.SetNoDelay(params.NoDelay)
+	}
+
+	opts := &sockopt.Options{}
+	if params.Window > 0 {
+		window := params.Window
+		opts.SndBuf = &window
+		opts.RcvBuf = &window
+	}
+	if params.Mss > 0 {
+		mss := params.Mss
+		opts.MaxSeg = &mss
+	}
+	if params.Congestion != "" {
+		congestion := params.Congestion
+		opts.CongestionControl = &congestion
+	}
+	// iperf3 paces the sender in the application, the kernel pacing rate is
+	// close enough for the reverse mode
+	rate := params.FqRate / 8
+	if params.Reverse && params.Bandwidth > 0 && (rate == 0 || params.Bandwidth/8 < rate) {
+		rate = params.Bandwidth / 8
+	}
+	if rate > 0 {
+		opts.MaxPacingRate = &rate
+	}
+	if opts.IsEmpty() {
+		return nil
+	}
+	return applySockOptions(conn, opts, nil)
+}
+
+func (t *iperfTest) addStream(conn net.Conn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed || len(t.streams) >= t.params.Parallel {
+		return false
+	}
+	t.streams = append(t.streams, &iperfStream{
+		id:   iperf3.StreamId(len(t.streams)),
+		conn: conn,
+	})
+	if len(t.streams) == t.params.Parallel {
+		close(t.ready)
+	}
+	return true
+}
+
+func (t *iperfTest) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for _, stream := range t.streams {
+		_ = stream.conn.Close()
+	}
+}
+
+// run starts the test, transfers data until the client ends the test and
+// exchanges the results.
+func (t *iperfTest) run(ctrl net.Conn, pool *payload.Pool) (*IperfTestJson, error) {
+	if err := iperf3.WriteState(ctrl, iperf3.StateTestStart); err != nil {
+		return nil, err
+	}
+	if err := iperf3.WriteState(ctrl, iperf3.StateTestRunning); err != nil {
+		return nil, err
+	}
+
+	// the cpu time, like the throughput, leaves out the omit period
+	var cpu atomic.Pointer[cpuMeter]
+	cpu.Store(startCpuMeter())
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	for _, stream := range t.streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if t.params.Reverse {
+				t.send(stream, pool)
+			} else {
+				t.receive(stream)
+			}
+		}()
+	}
+	omit := time.Duration(t.params.Omit) * time.Second
+	var omitTimer *time.Timer
+	if omit > 0 {
+		omitTimer = time.AfterFunc(omit, func() {
+			cpu.Store(startCpuMeter())
+			for _, stream := range t.streams {
+				stream.omitted.Store(stream.bytes.Load())
+			}
+		})
+	}
+
+	// the client decides when the test ends
+	timeout := maxTestDuration
+	if t.params.Time > 0 {
+		timeout = time.Duration(t.params.Time)*time.Second + omit + iperfSetupTimeout
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(timeout))
+	state, err := iperf3.ReadState(ctrl)
+	elapsed := time.Since(startTime)
+	if omitTimer != nil {
+		omitTimer.Stop()
+	}
+	cpuJson := cpu.Load().Stop()
+	for _, stream := range t.streams {
+		_ = stream.conn.SetDeadline(time.Now())
+	}
+	wg.Wait()
+	if err == nil && state != iperf3.StateTestEnd {
+		err = fmt.Errorf("unexpected %s", state)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := &IperfTestJson{
+		Params: &t.params,
+		Cpu:    cpuJson,
+	}
+	results := t.results(result, max(elapsed-omit, 0))
+
+	_ = ctrl.SetDeadline(time.Now().Add(iperfSetupTimeout))
+	if err := iperf3.WriteState(ctrl, iperf3.StateExchangeResults); err != nil {
+		return result, err
+	}
+	result.Client = &iperf3.Results{}
+	if err := iperf3.ReadJson(ctrl, result.Client); err != nil {
+		return result, err
+	}
+	if err := iperf3.WriteJson(ctrl, results); err != nil {
+		return result, err
+	}
+	if err := iperf3.WriteState(ctrl, iperf3.StateDisplayResults); err != nil {
+		return result, err
+	}
+	if state, err := iperf3.ReadState(ctrl); err != nil || state != iperf3.StateIperfDone {
+		log.Printf("iperf3 test did not end with IPERF_DONE: %v %v", state, err)
+	}
+	return result, nil
+}
+
+func (t *iperfTest) receive(stream *iperfStream) {
+	buffer := make([]byte, t.params.Len)
+	for {
+		n, err := stream.conn.Read(buffer)
+		stream.bytes.Add(int64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// send writes blocks of the pool, keyed per stream, until the test ends or
+// the byte or block count of the test is reached.
+func (t *iperfTest) send(stream *iperfStream, pool *payload.Pool) {
+	src := pool.Keyed()
+	limit := t.params.Num
+	if t.params.BlockCount > 0 {
+		limit = t.params.BlockCount * int64(t.params.Len)
+	}
+	var off int64
+	for {
+		n, err := stream.conn.Write(src.Chunk(off, t.params.Len))
+		off += int64(n)
+		stream.bytes.Add(int64(n))
+		total := t.sent.Add(int64(n))
+		if err != nil || (limit > 0 && total >= limit) {
+			return
+		}
+	}
+}
+
+// results fills in the streams of result and returns what is sent to the
+// client. elapsed is the duration without the omit period.
+func (t *iperfTest) results(result *IperfTestJson, elapsed time.Duration) *iperf3.Results {
+	results := &iperf3.Results{
+		SenderHasRetransmits: -1,
+	}
+	if result.Cpu != nil {
+		ms := float64(elapsed.Milliseconds())
+		if ms > 0 {
+			results.CpuUtilUser = float64(result.Cpu.UserMs) / ms * 100
+			results.CpuUtilSystem = float64(result.Cpu.SystemMs) / ms * 100
+			results.CpuUtilTotal = results.CpuUtilUser + results.CpuUtilSystem
+		}
+	}
+	if t.params.Reverse {
+		results.SenderHasRetransmits = 0
+	}
+
+	var output strings.Builder
+	for _, stream := range t.streams {
+		bytes := stream.bytes.Load() - stream.omitted.Load()
+		streamJson := IperfStreamJson{
+			Id:        stream.id,
+			Bytes:     bytes,
+			ElapsedMs: elapsed.Milliseconds(),
+			Tuning:    stream.tuning,
+		}
+		if elapsed > 0 {
+			streamJson.Throughput = float64(bytes*8) / elapsed.Seconds()
+		}
+		streamResult := iperf3.StreamResult{
+			Id:          stream.id,
+			Bytes:       bytes,
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		}
+
+		info, err := tcpinfo.GetTcpInfo(stream.conn)
+		if err != nil {
+			log.Printf("GetTcpInfo failed: %+v", err)
+		} else {
+			streamJson.TCPInfo = NewTCPInfoJson(info)
+			streamJson.Diagnosis = tcpinfo.Diagnose(info, nil, streamJson.Throughput)
+			if t.params.Reverse {
+				results.SenderHasRetransmits = 1
+				streamResult.Retransmits = int64(info.Retransmits)
+			}
+			if info.Congestion != nil {
+				results.CongestionUsed = info.Congestion.Name
+			}
+			fmt.Fprintf(&output, "[%3d] %d bytes in %.2f sec, %.2f Mbits/sec, rtt %d us, cwnd %d, retransmits %d: %s\n",
+				stream.id, bytes, elapsed.Seconds(), streamJson.Throughput/1000000,
+				info.RttUs, info.Cwnd, info.Retransmits, streamJson.Diagnosis.Explanation)
+		}
+
+		result.Streams = append(result.Streams, streamJson)
+		results.Streams = append(results.Streams, streamResult)
+	}
+	if t.params.GetServerOutput != 0 {
+		results.ServerOutputText = output.String()
+	}
+	return results
+}
@@ -1,132 +1,316 @@
 package main
 
 import (
-	crand "crypto/rand"
+	"bytes"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"embed"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/jclab-joseph/tcp-speed-problem-test/internal/certutil"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/footer"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/iperf3"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
 	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/units"
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
-	"github.com/quic-go/quic-go/qlog"
+	"github.com/quic-go/webtransport-go"
+	"io"
 	"io/fs"
 	"log"
 	"log/slog"
 	randv2 "math/rand/v2"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"slices"
 	"strconv"
+	"time"
 )
 
 //go:embed frontend
 var frontendFiles embed.FS
 
-type tcpInfoCollector struct {
+const (
+	minSampleInterval = 10 * time.Millisecond
+	maxTestDuration   = 5 * time.Minute
+
+	downloadChunkSize = 256 * 1024
+	uploadBufferSize  = 256 * 1024
+	// uploadDurationSlack is added to the duration of an upload
+	uploadDurationSlack = 2 * time.Second
+	// sendfileFooterSize is the padded size of the footer JSON when the
+	// download is sent with a Content-Length
+	sendfileFooterSize = 64 * 1024
+)
+
+var (
+	payloadPools *payload.PoolSet
+	useSendfile  bool
+)
+
+// resultTrailer is the HTTP trailer carrying the ResultJson of a download
+// requested with result=trailer.
+const resultTrailer = "X-Test-Result"
+
+// tuningHandler applies the socket tuning requested by a test to the TCP
+// connection of the request before the handler runs. The options stay on the
+// socket, so later requests on a kept-alive connection report them as well.
+type tuningHandler struct {
 	handler http.Handler
 }
 
-func (t *tcpInfoCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// Store original connection hijacker
-	hj, ok := w.(http.Hijacker)
-	if !ok {
-		log.Printf("Hijacking not supported")
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-
-	conn, bufrw, err := hj.Hijack()
-	if err != nil {
-		log.Printf("Hijacking not supported: %+v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+func (t *tuningHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if tcpCtx := GetTcpCtx(r.Context()); tcpCtx != nil {
+		if tuning := applyTuning(tcpCtx.NativeConn, r.URL.Query()); tuning != nil {
+			tcpCtx.SetTuning(tuning)
+		}
+		tcpCtx.Active.Add(1)
+		defer tcpCtx.Active.Add(-1)
 	}
+	t.handler.ServeHTTP(w, r)
+}
 
-	// Create new response writer with wrapped connection
-	newWriter := &responseWriter{
-		bufrw:  bufrw,
-		header: make(http.Header),
-	}
+// altSvcHandler advertises the HTTP/3 endpoint on the responses of the TCP
+// listeners, so that browsers discover QUIC without command line flags.
+type altSvcHandler struct {
+	handler http.Handler
+	value   string
+}
 
-	// Serve the original handler
-	reqCtx, appCtx := WithTcpCtx(r.Context())
-	appCtx.NativeConn = conn
-	t.handler.ServeHTTP(newWriter, r.WithContext(reqCtx))
-	newWriter.Flush()
-	_ = conn.Close()
+func (a *altSvcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Alt-Svc", a.value)
+	a.handler.ServeHTTP(w, r)
 }
 
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	tcpCtx := GetTcpCtx(r.Context())
 
-	var size int = 16
+	var size int64 = 16 * units.MiB
 	sizeStr := r.URL.Query().Get("size")
 	if sizeStr != "" {
-		n, err := strconv.ParseInt(sizeStr, 10, 32)
+		n, err := units.ParseSize(sizeStr, units.MiB)
 		if err != nil {
-			log.Printf("parse int failed: value=[%s]: %+v", sizeStr, err)
+			log.Printf("parse size failed: value=[%s]: %+v", sizeStr, err)
 		} else {
-			size = int(n)
+			size = n
 		}
 	}
+	// a duration bounded test streams until the deadline regardless of size
+	duration := parseTestDuration(r)
 
-	var seed [32]byte
-	_, _ = crand.Read(seed[:])
-	rnd := randv2.NewChaCha8(seed)
+	pattern, err := payload.ParsePattern(r.URL.Query().Get("pattern"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	seed := r.URL.Query().Get("seed")
+	source, err := newDownloadSource(pattern, seed)
+	if errors.Is(err, errSeedPattern) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("payload pool failed: %+v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// in trailer mode the body is pure payload and the result is sent as an
+	// HTTP trailer, otherwise it is appended as a footer
+	trailerMode := r.URL.Query().Get("result") == "trailer"
 
-	footerSize := 4096
-	dummySize := size * 1024 * 1024
-	totalBytes := dummySize + footerSize
+	// net/http only uses sendfile without chunked encoding, which needs a
+	// Content-Length: the footer is padded to a fixed size in that case
+	var file *os.File
+	if useSendfile && source.pool != nil && !trailerMode && duration == 0 && r.ProtoMajor == 1 && r.TLS == nil {
+		if file, err = source.pool.Open(); err != nil {
+			file = nil
+		} else {
+			defer file.Close()
+		}
+	}
 
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", strconv.Itoa(totalBytes))
-	if tcpCtx != nil {
-		w.Header().Set("Connection", "close")
+	if trailerMode {
+		w.Header().Set("Trailer", resultTrailer)
+		w.Header().Set("Access-Control-Expose-Headers", resultTrailer)
+	}
+	if file != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(size+sendfileFooterSize+footer.TailSize, 10))
 	}
 	w.WriteHeader(200)
 
-	chunk := make([]byte, 128*1024)
-	for i := 0; i < dummySize/len(chunk); i++ {
-		_, _ = rnd.Read(chunk)
-		for i := range chunk {
-			if chunk[i] == 0 {
-				chunk[i] = 1
-			}
+	var sampler *tcpinfo.Sampler
+	if interval := parseSampleInterval(r); tcpCtx != nil && interval > 0 {
+		sampler = tcpinfo.NewSampler(tcpCtx.NativeConn, interval)
+		sampler.Start()
+	}
+
+	cpu := startCpuMeter()
+	startTime := time.Now()
+	var sent int64
+	if file != nil {
+		sent, err = sendPoolFile(w, file, source.pool, source.off, size)
+	} else {
+		sent, err = source.write(w, size, duration, downloadChunkSize)
+	}
+	if err != nil {
+		log.Printf("write failed 1: %+v", err)
+	}
+
+	elapsed := time.Since(startTime)
+	cpuJson := cpu.Stop()
+	result := collectResult(r.Context(), sampler, sent, elapsed)
+	result.Protocol = r.Proto
+	result.Pattern = pattern
+	result.Cpu = cpuJson
+	result.Sendfile = file != nil
+	if source.hasher != nil {
+		result.Integrity = source.hasher.Integrity()
+	}
+
+	if trailerMode {
+		resultJson, _ := json.Marshal(result)
+		w.Header().Set(resultTrailer, string(resultJson))
+		return
+	}
+
+	padTo := 0
+	if file != nil {
+		padTo = sendfileFooterSize
+	}
+	footerBuffer, err := encodeResultFooter(result, padTo)
+	if err != nil {
+		log.Printf("footer encode failed: %+v", err)
+		return
+	}
+
+	if _, err := w.Write(footerBuffer); err != nil {
+		log.Printf("write failed 2: %+v", err)
+	}
+}
+
+// encodeResultFooter encodes result as a footer. With padTo the JSON is
+// padded to exactly that size, so the length of the body is known upfront.
+func encodeResultFooter(result *ResultJson, padTo int) ([]byte, error) {
+	limit := footer.MaxLength
+	if padTo > 0 {
+		limit = padTo
+	}
+	footerJson, _ := json.Marshal(result)
+	// thin out the series if it does not fit into a single footer
+	for len(footerJson) > limit && len(result.Samples) > 1 {
+		result.Samples = decimateSamples(result.Samples)
+		footerJson, _ = json.Marshal(result)
+	}
+	if padTo > 0 {
+		if len(footerJson) > padTo {
+			return nil, footer.ErrTooLarge
 		}
+		// trailing whitespace is still valid JSON
+		footerJson = append(footerJson, bytes.Repeat([]byte{' '}, padTo-len(footerJson))...)
+	}
+	return footer.Encode(footerJson)
+}
+
+var errSeedPattern = errors.New("seed requires the random pattern")
+
+// downloadSource is the payload of a download: the shared pool of the
+// pattern, keyed per download for random data, or for a seeded download the
+// reproducible stream of the seed, so that the client can verify every byte.
+// pool is only set where the payload is the pool itself.
+type downloadSource struct {
+	src    payload.Source
+	pool   *payload.Pool
+	hasher *payload.Hasher
+	off    int64
+}
+
+func newDownloadSource(pattern payload.Pattern, seed string) (*downloadSource, error) {
+	if seed != "" {
+		if pattern != payload.PatternRandom {
+			return nil, errSeedPattern
+		}
+		return &downloadSource{
+			src:    payload.NewStreamSource(payload.NewSeededReader(seed)),
+			hasher: payload.NewHasher(seed),
+		}, nil
+	}
+
+	pool, err := payloadPools.Get(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if pattern == payload.PatternRandom {
+		return &downloadSource{
+			src: pool.Keyed(),
+			off: randv2.Int64N(int64(pool.Size())),
+		}, nil
+	}
+	return &downloadSource{
+		src:  pool,
+		pool: pool,
+		// start at a random offset so consecutive downloads differ
+		off: randv2.Int64N(int64(pool.Size())),
+	}, nil
+}
 
-		if _, err := w.Write(chunk); err != nil {
-			log.Printf("write failed 1: %+v", err)
+// write writes size bytes of payload in chunks of chunkSize, or until the
+// duration has passed if it is not zero.
+func (s *downloadSource) write(w io.Writer, size int64, duration time.Duration, chunkSize int) (int64, error) {
+	deadline := time.Now().Add(duration)
+	var sent int64
+	for {
+		n := chunkSize
+		if duration > 0 {
+			if !time.Now().Before(deadline) {
+				break
+			}
+		} else if remain := size - sent; remain <= 0 {
 			break
+		} else if remain < int64(n) {
+			n = int(remain)
+		}
+
+		chunk := s.src.Chunk(s.off+sent, n)
+		written, err := w.Write(chunk)
+		sent += int64(written)
+		if s.hasher != nil {
+			_, _ = s.hasher.Write(chunk[:written])
+		}
+		if err != nil {
+			return sent, err
 		}
 
 		if f, ok := w.(http.Flusher); ok {
 			f.Flush()
 		}
 	}
+	return sent, nil
+}
 
-	footerBuffer := make([]byte, footerSize)
-
-	if tcpCtx != nil {
-		tcpInfo, err := tcpinfo.GetTcpInfo(tcpCtx.NativeConn)
+// sendPoolFile streams size bytes of the pool starting at off from the pool
+// file, which lets net/http or a *net.TCPConn hand the copy to sendfile.
+func sendPoolFile(w io.Writer, file *os.File, pool *payload.Pool, off int64, size int64) (int64, error) {
+	poolSize := int64(pool.Size())
+	var sent int64
+	for sent < size {
+		start := (off + sent) % poolSize
+		n := min(size-sent, poolSize-start)
+		if _, err := file.Seek(start, io.SeekStart); err != nil {
+			return sent, err
+		}
+		written, err := io.Copy(w, io.LimitReader(file, n))
+		sent += written
 		if err != nil {
-			log.Printf("GetTcpInfo failed: %+v", err)
-		} else {
-			tcpInfoJson := NewTCPInfoJson(tcpInfo)
-			footerJson, _ := json.Marshal(tcpInfoJson)
-			copy(footerBuffer[1:], footerJson)
+			return sent, err
 		}
 	}
-
-	if _, err := w.Write(footerBuffer); err != nil {
-		log.Printf("write failed 2: %+v", err)
-	}
+	return sent, nil
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -140,35 +324,165 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	interval := parseSampleInterval(r)
+	var sampler *tcpinfo.Sampler
+	if tcpCtx != nil && interval > 0 {
+		sampler = tcpinfo.NewSampler(tcpCtx.NativeConn, interval)
+		sampler.Start()
+	}
+	if interval <= 0 {
+		interval = defaultThroughputInterval
+	}
+
+	// the upload runs until the client ends the body; a duration only
+	// bounds it on the server side, late enough for the client to stop first
+	duration := parseTestDuration(r)
+	if duration > 0 {
+		duration += uploadDurationSlack
+	}
+
+	// a seeded upload is checked against the stream of the seed as it arrives
+	var verifier *payload.Verifier
+	if seed := r.URL.Query().Get("seed"); seed != "" {
+		verifier = payload.NewVerifier(seed)
+	}
+
 	// Read upload data
-	buffer := make([]byte, 1024)
-	totalBytes := 0
+	cpu := startCpuMeter()
+	meter := receivePayload(r.Body, uploadBufferSize, interval, duration, verifier)
+
+	log.Printf("Received %d bytes", meter.bytes)
+
+	cpuJson := cpu.Stop()
+	result := collectResult(r.Context(), sampler, meter.bytes, meter.Elapsed())
+	result.Protocol = r.Proto
+	result.Cpu = cpuJson
+	result.Timing, result.Intervals = meter.Finish()
+	if verifier != nil {
+		result.Integrity = verifier.Integrity(r.ContentLength)
+	}
+	sendData, _ := json.Marshal(result)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(sendData)))
+	w.WriteHeader(200)
+	_, _ = w.Write(sendData)
+}
+
+// receivePayload reads r to the end, or until the duration has passed if it
+// is not zero, feeding verifier when it is not nil.
+func receivePayload(r io.Reader, bufferSize int, interval time.Duration, duration time.Duration, verifier *payload.Verifier) *throughputMeter {
+	meter := newThroughputMeter(interval)
+	deadline := meter.start.Add(duration)
+	buffer := make([]byte, bufferSize)
 	for {
-		n, err := r.Body.Read(buffer)
-		totalBytes += n
+		n, err := r.Read(buffer)
+		meter.Add(n)
+		if verifier != nil {
+			_, _ = verifier.Write(buffer[:n])
+		}
 		if err != nil {
+			if err != io.EOF {
+				log.Printf("upload read failed: %+v", err)
+			}
+			break
+		}
+		if duration > 0 && !time.Now().Before(deadline) {
 			break
 		}
 	}
+	return meter
+}
 
-	log.Printf("Received %d bytes", totalBytes)
+// collectResult stops the sampler and takes the final TCP info snapshot of
+// the connection together with its diagnosis. For HTTP/3 requests it takes
+// the QUIC connection statistics instead.
+func collectResult(ctx context.Context, sampler *tcpinfo.Sampler, transferred int64, elapsed time.Duration) *ResultJson {
+	throughputBps := float64(transferred*8) / elapsed.Seconds()
+	result := &ResultJson{
+		Bytes:      transferred,
+		ElapsedMs:  elapsed.Milliseconds(),
+		Throughput: throughputBps,
+	}
+	if quicCtx := GetQuicCtx(ctx); quicCtx != nil {
+		result.QuicInfo = quicCtx.Stats()
+		result.Tls = quicCtx.Tls()
+		result.QuicConfig = quicCtx.Config
+	}
 
-	var sendData []byte
+	tcpCtx := GetTcpCtx(ctx)
+	if tcpCtx == nil {
+		return result
+	}
+	result.ConnId = tcpCtx.Id
+	result.Tuning = tcpCtx.Tuning()
+	result.Streams = tcpCtx.Active.Load()
+	result.Tls = tcpCtx.Tls
+	if sampler != nil {
+		result.Samples = sampler.Stop()
+	}
 	tcpInfo, err := tcpinfo.GetTcpInfo(tcpCtx.NativeConn)
 	if err != nil {
 		log.Printf("GetTcpInfo failed: %+v", err)
-	} else {
-		tcpInfoJson := NewTCPInfoJson(tcpInfo)
-		sendData, _ = json.Marshal(tcpInfoJson)
+		return result
 	}
+	result.TcpInfo = NewTCPInfoJson(tcpInfo)
+	result.Diagnosis = tcpinfo.Diagnose(tcpInfo, result.Samples, throughputBps)
+	return result
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", strconv.Itoa(len(sendData)))
-	if tcpCtx != nil {
-		w.Header().Set("Connection", "close")
+// parseSampleInterval returns the TCP info sampling interval requested with
+// the "sample" query parameter ("50ms" or plain milliseconds), 0 if disabled.
+func parseSampleInterval(r *http.Request) time.Duration {
+	v := r.URL.Query().Get("sample")
+	if v == "" {
+		return 0
 	}
-	w.WriteHeader(200)
-	_, _ = w.Write(sendData)
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			log.Printf("parse sample interval failed: value=[%s]: %+v", v, err)
+			return 0
+		}
+		interval = time.Duration(n) * time.Millisecond
+	}
+	if interval > 0 && interval < minSampleInterval {
+		interval = minSampleInterval
+	}
+	return interval
+}
+
+// parseTestDuration returns the test duration requested with the "duration"
+// query parameter ("10s" or plain seconds), 0 for a size bounded test.
+func parseTestDuration(r *http.Request) time.Duration {
+	v := r.URL.Query().Get("duration")
+	if v == "" {
+		return 0
+	}
+	duration, err := time.ParseDuration(v)
+	if err != nil {
+		n, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Printf("parse duration failed: value=[%s]: %+v", v, err)
+			return 0
+		}
+		duration = time.Duration(n * float64(time.Second))
+	}
+	if duration > maxTestDuration {
+		duration = maxTestDuration
+	}
+	return duration
+}
+
+// decimateSamples drops every other sample, keeping the last one.
+func decimateSamples(samples []tcpinfo.Sample) []tcpinfo.Sample {
+	out := make([]tcpinfo.Sample, 0, len(samples)/2+1)
+	for i := len(samples) - 1; i >= 0; i -= 2 {
+		out = append(out, samples[i])
+	}
+	slices.Reverse(out)
+	return out
 }
 
 func writeJson(w http.ResponseWriter, data interface{}) {
@@ -204,14 +518,35 @@ func main() {
 	var keyFile string
 	var generateCert bool
 	var cacheDir string
+	var poolSize int
+	var rawPort int
+	var iperfPort int
+	var udpPort int
+	var tlsPort int
+	var enableHttp2 bool
+	var altSvcMaxAge time.Duration
+	var shortLivedValidity time.Duration
+	var quicOpts quicOptions
 	flag.IntVar(&port, "port", port, "listen port")
 	flag.IntVar(&quicPort, "quic", -1, "enable quic server (0 is same to listen port)")
 	flag.StringVar(&certFile, "cert", "", "TLS certificate file")
 	flag.StringVar(&keyFile, "key", "", "TLS private key file")
 	flag.StringVar(&cacheDir, "cache", "", "cert cache directory")
 	flag.BoolVar(&generateCert, "generate-cert", false, "Generate self-signed certificate")
+	flag.DurationVar(&shortLivedValidity, "short-lived-cert", 0, fmt.Sprintf("instead of the certificate options, use an in-memory ECDSA certificate valid this long (at most %s) and renewed at half of it, which browsers accept for WebTransport by its hash from /api/certhash", certutil.MaxHashValidity))
+	flag.IntVar(&poolSize, "pool-size", 64, "size of the pre-generated payload of each pattern in MiB")
+	flag.BoolVar(&useSendfile, "sendfile", true, "send fixed size footer mode downloads of the pooled patterns with sendfile where supported")
+	flag.IntVar(&rawPort, "raw", -1, "enable the raw TCP test server on this port")
+	flag.IntVar(&iperfPort, "iperf", -1, fmt.Sprintf("enable the iperf3 compatible server on this port (iperf3 uses %d)", iperf3.DefaultPort))
+	flag.IntVar(&udpPort, "udp", -1, "enable the UDP loss and jitter test server on this port")
+	flag.IntVar(&tlsPort, "tls", -1, "enable the HTTPS (HTTP over TLS over TCP) server on this port, using the QUIC certificate options")
+	flag.BoolVar(&enableHttp2, "h2", true, "serve HTTP/2: h2 on the HTTPS port and h2c with prior knowledge on the plain port")
+	flag.DurationVar(&altSvcMaxAge, "alt-svc-max-age", 24*time.Hour, "how long browsers may remember the HTTP/3 endpoint advertised with Alt-Svc (0 disables it)")
+	quicOpts.addFlags()
 	flag.Parse()
 
+	payloadPools = payload.NewPoolSet(poolSize * int(units.MiB))
+
 	var err error
 
 	slog.SetLogLoggerLevel(slog.LevelDebug)
@@ -220,56 +555,36 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/api/downloading", downloadHandler)
 	mux.HandleFunc("/api/uploading", uploadHandler)
+	mux.HandleFunc("/api/ping", pingHandler)
+	mux.Handle("/api/ping/ws", pingWsServer)
 
+	// the certificate is shared by the QUIC and the HTTPS listeners
 	var spkiList []string
-	if quicPort >= 0 {
-		if quicPort == 0 {
-			quicPort = port
-		}
-
-		var tlsCert tls.Certificate
-
-		if generateCert {
-			_ = os.MkdirAll(cacheDir, 0700)
-
-			keyFile = filepath.Join(cacheDir, "key.pem")
-			certFile = filepath.Join(cacheDir, "cert.pem")
-
-			if _, err = os.Stat(keyFile); errors.Is(err, os.ErrNotExist) {
-				tlsCert, err = certutil.GenerateSelfSignedCert()
-				if err != nil {
-					log.Fatal("Failed to generate certificate:", err)
-				}
-				privateKeyDer, err := x509.MarshalPKCS8PrivateKey(tlsCert.PrivateKey)
-				if err != nil {
-					log.Fatal("Failed to marshal private key:", err)
-				}
-				privateKeyPem := &pem.Block{
-					Type:  "PRIVATE KEY",
-					Bytes: privateKeyDer,
-				}
-				err = os.WriteFile(keyFile, pem.EncodeToMemory(privateKeyPem), 0600)
-				if err != nil {
-					log.Fatal("Failed to write private key:", err)
-				}
-				certPem := &pem.Block{
-					Type:  "CERTIFICATE",
-					Bytes: tlsCert.Certificate[0],
-				}
-				err = os.WriteFile(certFile, pem.EncodeToMemory(certPem), 0600)
-				if err != nil {
-					log.Fatal("Failed to write certificate:", err)
-				}
+	var tlsConfig *tls.Config
+	var currentCert func() (*tls.Certificate, error)
+	if quicPort >= 0 || tlsPort >= 0 {
+		if shortLivedValidity > 0 {
+			// the key never changes, so the SPKI hash stays valid across renewals
+			shortLived, err := newShortLivedCert(shortLivedValidity)
+			if err != nil {
+				log.Fatal("Failed to generate certificate:", err)
+			}
+			currentCert = shortLived.Current
+			tlsConfig = &tls.Config{
+				GetCertificate: shortLived.GetCertificate,
+			}
+		} else {
+			tlsCert := loadCertificate(certFile, keyFile, cacheDir, generateCert)
+			currentCert = func() (*tls.Certificate, error) {
+				return &tlsCert, nil
+			}
+			tlsConfig = &tls.Config{
+				Certificates: []tls.Certificate{tlsCert},
 			}
 		}
-
-		tlsCert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		tlsCert, err := currentCert()
 		if err != nil {
-			log.Fatal("Failed to load certificate:", err)
-		}
-
-		tlsConfig := &tls.Config{
-			Certificates: []tls.Certificate{tlsCert},
+			log.Fatal("Failed to get certificate:", err)
 		}
 		for i, bytes := range tlsCert.Certificate {
 			spki, err := certutil.GetSpkiHashFromCertDer(bytes)
@@ -279,25 +594,93 @@ func main() {
 			spkiList = append(spkiList, spki)
 			log.Printf("SPKI[%d] HASH: %s", i, spki)
 		}
+	}
 
-		// HTTP/3 (QUIC) 서버
-		quicServer := &http3.Server{
-			Addr:      fmt.Sprintf(":%d", quicPort),
-			Handler:   mux,
-			TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
-			QUICConfig: &quic.Config{
-				Tracer: qlog.DefaultConnectionTracer,
-			},
+	if quicPort >= 0 {
+		if quicPort == 0 {
+			quicPort = port
 		}
 
-		headers := make(http.Header)
-		_ = quicServer.SetQUICHeaders(headers)
-		log.Printf("quic headers : %+v", headers)
+		quicConfig, quicConfigJson, err := quicOpts.config()
+		if err != nil {
+			log.Fatal("Invalid QUIC options:", err)
+		}
+		log.Printf("QUIC config: %+v", *quicConfigJson)
+
+		// HTTP/3 (QUIC) 서버, WebTransport 세션도 같은 서버에서 처리
+		wtServer := &webtransport.Server{
+			H3: http3.Server{
+				Addr:       fmt.Sprintf(":%d", quicPort),
+				Handler:    mux,
+				TLSConfig:  http3.ConfigureTLSConfig(tlsConfig),
+				QUICConfig: quicConfig,
+				ConnContext: func(ctx context.Context, c quic.Connection) context.Context {
+					if quicCtx := GetQuicCtx(ctx); quicCtx != nil {
+						quicCtx.Conn = c
+					}
+					return ctx
+				},
+			},
+			// the page may be served by another listener than the QUIC one
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		}
+		quicServer := &wtServer.H3
+		mux.Handle(webTransportPath, &webTransportHandler{server: wtServer})
+		mux.HandleFunc("/api/certhash", func(writer http.ResponseWriter, request *http.Request) {
+			cert, err := currentCert()
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			certHash, err := newCertHashJson(cert)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			certHash.Port = quicPort
+			certHash.Path = webTransportPath
+			writeJson(writer, certHash)
+		})
+
+		// the transport puts a QuicCtx into every connection context, where
+		// both the tracer and the request handlers can find it
+		udpAddr, err := net.ResolveUDPAddr("udp", quicServer.Addr)
+		if err != nil {
+			log.Fatal("Failed to resolve QUIC address:", err)
+		}
+		udpConn, err := net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			log.Fatal("Failed to listen QUIC:", err)
+		}
+		quicTransport := &quic.Transport{
+			Conn: udpConn,
+			ConnContext: func(ctx context.Context) context.Context {
+				ctx, quicCtx := WithQuicCtx(ctx)
+				quicCtx.Config = quicConfigJson
+				return ctx
+			},
+		}
+		quicListener, err := quicTransport.ListenEarly(quicServer.TLSConfig, quicServer.QUICConfig)
+		if err != nil {
+			log.Fatal("Failed to listen QUIC:", err)
+		}
 
+		// connections are handed to the WebTransport server, which sets up
+		// its HTTP/3 settings on first use
 		go func() {
 			log.Printf("Starting HTTP/3 (QUIC) server on %s", quicServer.Addr)
-			if err := quicServer.ListenAndServe(); err != nil {
-				log.Fatal("QUIC server error:", err)
+			for {
+				conn, err := quicListener.Accept(context.Background())
+				if err != nil {
+					log.Fatal("QUIC server error:", err)
+				}
+				go func() {
+					if err := wtServer.ServeQUICConn(conn); err != nil {
+						log.Printf("QUIC connection failed: %+v", err)
+					}
+				}()
 			}
 		}()
 	}
@@ -313,11 +696,91 @@ func main() {
 	}
 	mux.Handle("/", http.FileServer(http.FS(frontendFS)))
 
-	collector := &tcpInfoCollector{handler: mux}
-
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: collector,
+		Addr:      fmt.Sprintf(":%d", port),
+		Handler:   &tuningHandler{handler: mux},
+		Protocols: &http.Protocols{},
+		// keep the connection of every request reachable through TcpCtx
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx, tcpCtx := WithTcpCtx(ctx)
+			tcpCtx.NativeConn = c
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				withTlsConn(tcpCtx, tlsConn)
+			}
+			return ctx
+		},
+	}
+
+	// quic-go only knows the Alt-Svc value once it is serving and has a fixed
+	// max age, so the header is built here
+	if quicPort >= 0 && altSvcMaxAge > 0 {
+		server.Handler = &altSvcHandler{
+			handler: server.Handler,
+			value:   fmt.Sprintf(`h3=":%d"; ma=%d`, quicPort, int64(altSvcMaxAge.Seconds())),
+		}
+	}
+
+	server.Protocols.SetHTTP1(true)
+	if enableHttp2 {
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	if tlsPort >= 0 {
+		tcpListener, err := net.Listen("tcp", fmt.Sprintf(":%d", tlsPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		httpsConfig := tlsConfig.Clone()
+		httpsConfig.NextProtos = []string{"http/1.1"}
+		if enableHttp2 {
+			httpsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		go func() {
+			log.Printf("Starting HTTPS server on %s", tcpListener.Addr())
+			if err := server.Serve(newTlsListener(tcpListener, httpsConfig)); err != nil {
+				log.Fatal("HTTPS server error:", err)
+			}
+		}()
+	}
+
+	if rawPort >= 0 {
+		rawListener, err := net.Listen("tcp", fmt.Sprintf(":%d", rawPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Starting raw TCP server on %s", rawListener.Addr())
+			if err := serveRaw(rawListener); err != nil {
+				log.Fatal("raw TCP server error:", err)
+			}
+		}()
+	}
+
+	if iperfPort >= 0 {
+		iperfListener, err := net.Listen("tcp", fmt.Sprintf(":%d", iperfPort))
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Starting iperf3 server on %s", iperfListener.Addr())
+			if err := serveIperf(iperfListener); err != nil {
+				log.Fatal("iperf3 server error:", err)
+			}
+		}()
+	}
+
+	if udpPort >= 0 {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: udpPort})
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("Starting UDP test server on %s", udpConn.LocalAddr())
+			if err := serveUdp(udpConn); err != nil {
+				log.Fatal("UDP test server error:", err)
+			}
+		}()
 	}
 
 	log.Printf("Server starting on %s", server.Addr)
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"golang.org/x/net/websocket"
+	"net/http"
+	"time"
+)
+
+// pingHandler answers as fast as possible for latency measurements.
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJson(w, &PingJson{ServerTime: time.Now().UnixNano()})
+}
+
+// pingWsServer echoes every WebSocket message back, so that pings on an
+// established connection measure the round trip without HTTP overhead.
+// Like the other test endpoints it accepts any origin.
+var pingWsServer = websocket.Server{
+	Handshake: func(*websocket.Config, *http.Request) error {
+		return nil
+	},
+	Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		var msg string
+		for {
+			if err := websocket.Message.Receive(ws, &msg); err != nil {
+				return
+			}
+			if err := websocket.Message.Send(ws, msg); err != nil {
+				return
+			}
+		}
+	},
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/units"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+	"net"
+	"sync"
+	"time"
+)
+
+// QuicCtx is the QUIC counterpart of TcpCtx. The statistics are collected by
+// a logging.ConnectionTracer, since QUIC has no kernel TCP_INFO.
+type QuicCtx struct {
+	Conn quic.Connection
+
+	// Config is the effective configuration of the server
+	Config *QuicConfigJson
+
+	mu    sync.Mutex
+	stats QuicInfoJson
+	// the handshake is timed from the first packet until the handshake
+	// keys are dropped, which the server does once the handshake completed
+	startTime time.Time
+	handshake time.Duration
+}
+
+// Stats returns a snapshot of the connection statistics.
+func (q *QuicCtx) Stats() *QuicInfoJson {
+	q.mu.Lock()
+	stats := q.stats
+	q.mu.Unlock()
+	if q.Conn != nil {
+		state := q.Conn.ConnectionState()
+		stats.Version = state.Version.String()
+		stats.Used0Rtt = state.Used0RTT
+	}
+	return &stats
+}
+
+// Tls returns the TLS session of the connection.
+func (q *QuicCtx) Tls() *TlsJson {
+	if q.Conn == nil {
+		return nil
+	}
+	q.mu.Lock()
+	handshake := q.handshake
+	q.mu.Unlock()
+	return newTlsJson(q.Conn.ConnectionState().TLS, handshake)
+}
+
+func (q *QuicCtx) newTracer() *logging.ConnectionTracer {
+	return &logging.ConnectionTracer{
+		StartedConnection: func(local, remote net.Addr, srcConnID, destConnID logging.ConnectionID) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.startTime = time.Now()
+		},
+		DroppedEncryptionLevel: func(encLevel logging.EncryptionLevel) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			if encLevel == logging.EncryptionHandshake && q.handshake == 0 {
+				q.handshake = time.Since(q.startTime)
+			}
+		},
+		SentLongHeaderPacket: func(hdr *logging.ExtendedHeader, size logging.ByteCount, ecn logging.ECN, ack *logging.AckFrame, frames []logging.Frame) {
+			q.sentPacket(size)
+		},
+		SentShortHeaderPacket: func(hdr *logging.ShortHeader, size logging.ByteCount, ecn logging.ECN, ack *logging.AckFrame, frames []logging.Frame) {
+			q.sentPacket(size)
+		},
+		ReceivedLongHeaderPacket: func(hdr *logging.ExtendedHeader, size logging.ByteCount, ecn logging.ECN, frames []logging.Frame) {
+			q.receivedPacket(size)
+		},
+		ReceivedShortHeaderPacket: func(hdr *logging.ShortHeader, size logging.ByteCount, ecn logging.ECN, frames []logging.Frame) {
+			q.receivedPacket(size)
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.stats.RttUs = rttStats.SmoothedRTT().Microseconds()
+			q.stats.MinRttUs = rttStats.MinRTT().Microseconds()
+			q.stats.LatestRttUs = rttStats.LatestRTT().Microseconds()
+			q.stats.RttVarUs = rttStats.MeanDeviation().Microseconds()
+			q.stats.Cwnd = uint64(cwnd)
+			q.stats.BytesInFlight = uint64(bytesInFlight)
+		},
+		LostPacket: func(encLevel logging.EncryptionLevel, pn logging.PacketNumber, reason logging.PacketLossReason) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.stats.PacketsLost++
+		},
+		UpdatedMTU: func(mtu logging.ByteCount, done bool) {
+			q.mu.Lock()
+			defer q.mu.Unlock()
+			q.stats.Mtu = uint64(mtu)
+		},
+	}
+}
+
+func (q *QuicCtx) sentPacket(size logging.ByteCount) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.PacketsOut++
+	q.stats.BytesOut += uint64(size)
+}
+
+func (q *QuicCtx) receivedPacket(size logging.ByteCount) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats.PacketsIn++
+	q.stats.BytesIn += uint64(size)
+}
+
+// newQuicConnectionTracer is the quic.Config.Tracer of the HTTP/3 server. It
+// feeds the QuicCtx stored in the connection context by the transport and
+// keeps writing qlog files when QLOGDIR is set.
+func newQuicConnectionTracer(ctx context.Context, p logging.Perspective, connID quic.ConnectionID) *logging.ConnectionTracer {
+	var tracers []*logging.ConnectionTracer
+	if tracer := qlog.DefaultConnectionTracer(ctx, p, connID); tracer != nil {
+		tracers = append(tracers, tracer)
+	}
+	if quicCtx := GetQuicCtx(ctx); quicCtx != nil {
+		tracers = append(tracers, quicCtx.newTracer())
+	}
+	return logging.NewMultiplexedConnectionTracer(tracers...)
+}
+
+// quic-go defaults of the quic.Config fields left zero, from its
+// internal/protocol package
+const (
+	quicDefaultStreamWindow     = 512 * 1024
+	quicDefaultMaxStreamWindow  = 6 * 1024 * 1024
+	quicDefaultConnWindow       = quicDefaultStreamWindow * 3 / 2
+	quicDefaultMaxConnWindow    = 15 * 1024 * 1024
+	quicDefaultMaxStreams       = 100
+	quicDefaultIdleTimeout      = 30 * time.Second
+	quicDefaultHandshakeTimeout = 5 * time.Second
+	quicDefaultPacketSize       = 1280
+	quicMinPacketSize           = 1200
+	quicMaxPacketSize           = 1452
+)
+
+// quicOptions are the -quic-* flags of the HTTP/3 server. Zero keeps the
+// quic-go default.
+type quicOptions struct {
+	streamWindow      string
+	maxStreamWindow   string
+	connWindow        string
+	maxConnWindow     string
+	maxStreams        int64
+	maxUniStreams     int64
+	idleTimeout       time.Duration
+	handshakeTimeout  time.Duration
+	keepAlive         time.Duration
+	initialPacketSize uint
+	disablePmtud      bool
+	allow0Rtt         bool
+}
+
+func (o *quicOptions) addFlags() {
+	flag.StringVar(&o.streamWindow, "quic-stream-window", "", "initial receive window of a QUIC stream (e.g. 1M, quic-go default 512K)")
+	flag.StringVar(&o.maxStreamWindow, "quic-max-stream-window", "", "largest receive window a QUIC stream grows to (quic-go default 6M)")
+	flag.StringVar(&o.connWindow, "quic-conn-window", "", "initial receive window of a QUIC connection (quic-go default 768K)")
+	flag.StringVar(&o.maxConnWindow, "quic-max-conn-window", "", "largest receive window a QUIC connection grows to (quic-go default 15M)")
+	flag.Int64Var(&o.maxStreams, "quic-max-streams", 0, fmt.Sprintf("concurrent bidirectional streams a client may open (quic-go default %d)", quicDefaultMaxStreams))
+	flag.Int64Var(&o.maxUniStreams, "quic-max-uni-streams", 0, fmt.Sprintf("concurrent unidirectional streams a client may open (quic-go default %d)", quicDefaultMaxStreams))
+	flag.DurationVar(&o.idleTimeout, "quic-idle-timeout", 0, fmt.Sprintf("close QUIC connections idle this long (quic-go default %s)", quicDefaultIdleTimeout))
+	flag.DurationVar(&o.handshakeTimeout, "quic-handshake-timeout", 0, fmt.Sprintf("give up QUIC handshakes idle this long (quic-go default %s)", quicDefaultHandshakeTimeout))
+	flag.DurationVar(&o.keepAlive, "quic-keep-alive", 0, "send a QUIC keep-alive after this much idle time (0 disables it)")
+	flag.UintVar(&o.initialPacketSize, "quic-initial-packet-size", 0, fmt.Sprintf("QUIC packet size before path MTU discovery, %d to %d (quic-go default %d)", quicMinPacketSize, quicMaxPacketSize, quicDefaultPacketSize))
+	flag.BoolVar(&o.disablePmtud, "quic-disable-pmtud", false, "disable QUIC path MTU discovery")
+	flag.BoolVar(&o.allow0Rtt, "quic-0rtt", false, "accept 0-RTT data from resumed QUIC connections")
+}
+
+// config returns the quic.Config of the options and its effective values.
+func (o *quicOptions) config() (*quic.Config, *QuicConfigJson, error) {
+	var windows [4]uint64
+	for i, s := range []string{o.streamWindow, o.maxStreamWindow, o.connWindow, o.maxConnWindow} {
+		if s == "" {
+			continue
+		}
+		n, err := units.ParseSize(s, 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		windows[i] = uint64(n)
+	}
+	if o.maxStreams < 0 || o.maxUniStreams < 0 {
+		return nil, nil, errors.New("negative QUIC stream limit")
+	}
+	if o.initialPacketSize != 0 && (o.initialPacketSize < quicMinPacketSize || o.initialPacketSize > quicMaxPacketSize) {
+		return nil, nil, fmt.Errorf("QUIC initial packet size must be between %d and %d: %d", quicMinPacketSize, quicMaxPacketSize, o.initialPacketSize)
+	}
+
+	config := &quic.Config{
+		InitialStreamReceiveWindow:     windows[0],
+		MaxStreamReceiveWindow:         windows[1],
+		InitialConnectionReceiveWindow: windows[2],
+		MaxConnectionReceiveWindow:     windows[3],
+		MaxIncomingStreams:             o.maxStreams,
+		MaxIncomingUniStreams:          o.maxUniStreams,
+		MaxIdleTimeout:                 o.idleTimeout,
+		HandshakeIdleTimeout:           o.handshakeTimeout,
+		KeepAlivePeriod:                o.keepAlive,
+		InitialPacketSize:              uint16(o.initialPacketSize),
+		DisablePathMTUDiscovery:        o.disablePmtud,
+		Allow0RTT:                      o.allow0Rtt,
+		Tracer:                         newQuicConnectionTracer,
+		// WebTransport requires HTTP datagrams
+		EnableDatagrams: true,
+	}
+	effective := newQuicConfigJson(config)
+	if effective.InitialStreamReceiveWindow > effective.MaxStreamReceiveWindow {
+		return nil, nil, fmt.Errorf("QUIC stream window %d is larger than the maximum %d", effective.InitialStreamReceiveWindow, effective.MaxStreamReceiveWindow)
+	}
+	if effective.InitialConnectionReceiveWindow > effective.MaxConnectionReceiveWindow {
+		return nil, nil, fmt.Errorf("QUIC connection window %d is larger than the maximum %d", effective.InitialConnectionReceiveWindow, effective.MaxConnectionReceiveWindow)
+	}
+	return config, effective, nil
+}
+
+// newQuicConfigJson fills in the defaults quic-go applies to the zero fields
+// of config.
+func newQuicConfigJson(config *quic.Config) *QuicConfigJson {
+	orDefault := func(v, def uint64) uint64 {
+		if v == 0 {
+			return def
+		}
+		return v
+	}
+	orDefaultDuration := func(v, def time.Duration) int64 {
+		if v == 0 {
+			v = def
+		}
+		return v.Milliseconds()
+	}
+	return &QuicConfigJson{
+		InitialStreamReceiveWindow:     orDefault(config.InitialStreamReceiveWindow, quicDefaultStreamWindow),
+		MaxStreamReceiveWindow:         orDefault(config.MaxStreamReceiveWindow, quicDefaultMaxStreamWindow),
+		InitialConnectionReceiveWindow: orDefault(config.InitialConnectionReceiveWindow, quicDefaultConnWindow),
+		MaxConnectionReceiveWindow:     orDefault(config.MaxConnectionReceiveWindow, quicDefaultMaxConnWindow),
+		MaxIncomingStreams:             int64(orDefault(uint64(config.MaxIncomingStreams), quicDefaultMaxStreams)),
+		MaxIncomingUniStreams:          int64(orDefault(uint64(config.MaxIncomingUniStreams), quicDefaultMaxStreams)),
+		MaxIdleTimeoutMs:               orDefaultDuration(config.MaxIdleTimeout, quicDefaultIdleTimeout),
+		HandshakeIdleTimeoutMs:         orDefaultDuration(config.HandshakeIdleTimeout, quicDefaultHandshakeTimeout),
+		KeepAlivePeriodMs:              config.KeepAlivePeriod.Milliseconds(),
+		InitialPacketSize:              uint16(orDefault(uint64(config.InitialPacketSize), quicDefaultPacketSize)),
+		DisablePathMTUDiscovery:        config.DisablePathMTUDiscovery,
+		Allow0Rtt:                      config.Allow0RTT,
+		EnableDatagrams:                config.EnableDatagrams,
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/payload"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/rawtcp"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/units"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// rawRequestTimeout bounds the time a client may take to send its request
+	rawRequestTimeout    = 10 * time.Second
+	defaultRawBufferSize = 128 * 1024
+)
+
+// serveRaw accepts connections of the raw TCP protocol (see pkg/rawtcp).
+func serveRaw(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleRawConn(conn)
+	}
+}
+
+func handleRawConn(conn net.Conn) {
+	defer conn.Close()
+
+	// the result is collected from the context like for HTTP requests
+	ctx, tcpCtx := WithTcpCtx(context.Background())
+	tcpCtx.NativeConn = conn
+
+	reader := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(rawRequestTimeout))
+	var req rawtcp.Request
+	if err := rawtcp.ReadLine(reader, &req); err != nil {
+		log.Printf("raw request failed: %+v", err)
+		return
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	pattern, err := checkRawRequest(&req)
+	if err != nil {
+		_ = rawtcp.WriteLine(conn, &rawtcp.Response{Error: err.Error()})
+		return
+	}
+	if req.Tuning != nil && !req.Tuning.IsEmpty() {
+		tcpCtx.SetTuning(applySockOptions(conn, req.Tuning, nil))
+	}
+	if err := rawtcp.WriteLine(conn, &rawtcp.Response{}); err != nil {
+		log.Printf("raw response failed: %+v", err)
+		return
+	}
+
+	log.Printf("raw %s test from %s", req.Direction, conn.RemoteAddr())
+	switch req.Direction {
+	case rawtcp.DirectionDownload:
+		rawDownload(ctx, conn, &req, pattern)
+	case rawtcp.DirectionUpload:
+		// the reader may already hold the first bytes of the upload
+		rawUpload(ctx, conn, reader, &req)
+	}
+}
+
+// checkRawRequest validates req and fills in the defaults.
+func checkRawRequest(req *rawtcp.Request) (payload.Pattern, error) {
+	if req.Version != rawtcp.Version {
+		return "", fmt.Errorf("unsupported version %d", req.Version)
+	}
+	if req.Direction != rawtcp.DirectionDownload && req.Direction != rawtcp.DirectionUpload {
+		return "", fmt.Errorf("invalid direction: %s", req.Direction)
+	}
+	if req.DurationMs < 0 || req.Size < 0 || req.BufferSize < 0 || req.SampleMs < 0 {
+		return "", errors.New("negative parameter")
+	}
+	if req.Duration() > maxTestDuration {
+		req.DurationMs = maxTestDuration.Milliseconds()
+	}
+	if req.DurationMs == 0 && req.Size == 0 {
+		req.Size = 16 * units.MiB
+	}
+	if req.BufferSize == 0 {
+		req.BufferSize = defaultRawBufferSize
+	}
+	req.BufferSize = min(req.BufferSize, payload.MaxChunkSize)
+
+	pattern, err := payload.ParsePattern(req.Pattern)
+	if err != nil {
+		return "", err
+	}
+	if req.Seed != "" && pattern != payload.PatternRandom {
+		return "", errSeedPattern
+	}
+	return pattern, nil
+}
+
+func rawSampleInterval(req *rawtcp.Request) time.Duration {
+	interval := time.Duration(req.SampleMs) * time.Millisecond
+	if interval > 0 && interval < minSampleInterval {
+		interval = minSampleInterval
+	}
+	return interval
+}
+
+// rawDownload streams the payload and appends the result as a footer. w is
+// the connection, or a stream of a WebTransport session which has neither
+// TCP info nor sendfile.
+func rawDownload(ctx context.Context, w io.Writer, req *rawtcp.Request, pattern payload.Pattern) {
+	source, err := newDownloadSource(pattern, req.Seed)
+	if err != nil {
+		log.Printf("payload pool failed: %+v", err)
+		return
+	}
+
+	conn, _ := w.(net.Conn)
+
+	// without HTTP in the way, every size bounded download can use sendfile
+	var file *os.File
+	if conn != nil && useSendfile && source.pool != nil && req.DurationMs == 0 {
+		if file, err = source.pool.Open(); err != nil {
+			file = nil
+		} else {
+			defer file.Close()
+		}
+	}
+
+	var sampler *tcpinfo.Sampler
+	if interval := rawSampleInterval(req); interval > 0 && conn != nil {
+		sampler = tcpinfo.NewSampler(conn, interval)
+		sampler.Start()
+	}
+
+	cpu := startCpuMeter()
+	startTime := time.Now()
+	var sent int64
+	if file != nil {
+		sent, err = sendPoolFile(conn, file, source.pool, source.off, req.Size)
+	} else {
+		sent, err = source.write(w, req.Size, req.Duration(), req.BufferSize)
+	}
+	if err != nil {
+		log.Printf("raw write failed: %+v", err)
+		return
+	}
+
+	elapsed := time.Since(startTime)
+	cpuJson := cpu.Stop()
+	result := collectResult(ctx, sampler, sent, elapsed)
+	result.Pattern = pattern
+	result.Cpu = cpuJson
+	result.Sendfile = file != nil
+	if source.hasher != nil {
+		result.Integrity = source.hasher.Integrity()
+	}
+
+	footerBuffer, err := encodeResultFooter(result, 0)
+	if err != nil {
+		log.Printf("footer encode failed: %+v", err)
+		return
+	}
+	if _, err := w.Write(footerBuffer); err != nil {
+		log.Printf("raw write failed: %+v", err)
+	}
+}
+
+// rawUpload sinks the payload until the client half-closes the connection
+// and answers with the result. Like rawDownload, w may be a WebTransport
+// stream.
+func rawUpload(ctx context.Context, w io.Writer, reader *bufio.Reader, req *rawtcp.Request) {
+	interval := rawSampleInterval(req)
+	var sampler *tcpinfo.Sampler
+	if interval <= 0 {
+		interval = defaultThroughputInterval
+	} else if conn, ok := w.(net.Conn); ok {
+		sampler = tcpinfo.NewSampler(conn, interval)
+		sampler.Start()
+	}
+
+	duration := req.Duration()
+	if duration > 0 {
+		duration += uploadDurationSlack
+	}
+
+	var verifier *payload.Verifier
+	if req.Seed != "" {
+		verifier = payload.NewVerifier(req.Seed)
+	}
+
+	cpu := startCpuMeter()
+	meter := receivePayload(reader, req.BufferSize, interval, duration, verifier)
+
+	cpuJson := cpu.Stop()
+	result := collectResult(ctx, sampler, meter.bytes, meter.Elapsed())
+	result.Cpu = cpuJson
+	result.Timing, result.Intervals = meter.Finish()
+	if verifier != nil {
+		// the client sends exactly the size unless the test is bounded by
+		// duration
+		expected := int64(-1)
+		if req.DurationMs == 0 {
+			expected = req.Size
+		}
+		result.Integrity = verifier.Integrity(expected)
+	}
+	if err := rawtcp.WriteLine(w, result); err != nil {
+		log.Printf("raw write failed: %+v", err)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "time"
+
+// defaultThroughputInterval is used for the per interval throughput of an
+// upload when no sample interval was requested.
+const defaultThroughputInterval = 500 * time.Millisecond
+
+// throughputMeter measures a transfer from the first to the last byte and
+// splits it into fixed intervals.
+type throughputMeter struct {
+	start    time.Time
+	interval time.Duration
+
+	firstByte time.Time
+	lastByte  time.Time
+	bytes     int64
+
+	intervalStart time.Time
+	intervalBytes int64
+	intervals     []IntervalJson
+}
+
+func newThroughputMeter(interval time.Duration) *throughputMeter {
+	return &throughputMeter{
+		start:    time.Now(),
+		interval: interval,
+	}
+}
+
+// Add records n bytes that have just been received.
+func (m *throughputMeter) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	now := time.Now()
+	if m.firstByte.IsZero() {
+		m.firstByte = now
+		m.intervalStart = now
+	}
+	m.lastByte = now
+	m.bytes += int64(n)
+	m.intervalBytes += int64(n)
+	if now.Sub(m.intervalStart) >= m.interval {
+		m.flush(now)
+	}
+}
+
+func (m *throughputMeter) flush(now time.Time) {
+	elapsed := now.Sub(m.intervalStart)
+	interval := IntervalJson{
+		TimeMs:     m.intervalStart.Sub(m.firstByte).Milliseconds(),
+		DurationMs: elapsed.Milliseconds(),
+		Bytes:      m.intervalBytes,
+	}
+	if elapsed > 0 {
+		interval.Throughput = float64(m.intervalBytes*8) / elapsed.Seconds()
+	}
+	m.intervals = append(m.intervals, interval)
+	m.intervalStart = now
+	m.intervalBytes = 0
+}
+
+// Elapsed is the time from the first to the last byte, or from the start if
+// everything arrived in a single read.
+func (m *throughputMeter) Elapsed() time.Duration {
+	if elapsed := m.lastByte.Sub(m.firstByte); elapsed > 0 {
+		return elapsed
+	}
+	return time.Since(m.start)
+}
+
+// Finish closes the last interval and returns the timing of the transfer.
+func (m *throughputMeter) Finish() (*TimingJson, []IntervalJson) {
+	if m.firstByte.IsZero() {
+		return nil, nil
+	}
+	if m.intervalBytes > 0 {
+		m.flush(m.lastByte)
+	}
+	return &TimingJson{
+		FirstByteMs: float64(m.firstByte.Sub(m.start).Microseconds()) / 1000,
+		LastByteMs:  float64(m.lastByte.Sub(m.start).Microseconds()) / 1000,
+	}, m.intervals
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/jclab-joseph/tcp-speed-problem-test/internal/certutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the handshake of the HTTPS listener
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadCertificate loads the certificate of the TLS listeners. With
+// generateCert a self-signed certificate is created in cacheDir on first use.
+func loadCertificate(certFile, keyFile, cacheDir string, generateCert bool) tls.Certificate {
+	if generateCert {
+		_ = os.MkdirAll(cacheDir, 0700)
+
+		keyFile = filepath.Join(cacheDir, "key.pem")
+		certFile = filepath.Join(cacheDir, "cert.pem")
+
+		if _, err := os.Stat(keyFile); errors.Is(err, os.ErrNotExist) {
+			tlsCert, err := certutil.GenerateSelfSignedCert()
+			if err != nil {
+				log.Fatal("Failed to generate certificate:", err)
+			}
+			privateKeyDer, err := x509.MarshalPKCS8PrivateKey(tlsCert.PrivateKey)
+			if err != nil {
+				log.Fatal("Failed to marshal private key:", err)
+			}
+			privateKeyPem := &pem.Block{
+				Type:  "PRIVATE KEY",
+				Bytes: privateKeyDer,
+			}
+			err = os.WriteFile(keyFile, pem.EncodeToMemory(privateKeyPem), 0600)
+			if err != nil {
+				log.Fatal("Failed to write private key:", err)
+			}
+			certPem := &pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: tlsCert.Certificate[0],
+			}
+			err = os.WriteFile(certFile, pem.EncodeToMemory(certPem), 0600)
+			if err != nil {
+				log.Fatal("Failed to write certificate:", err)
+			}
+		}
+	}
+
+	tlsCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		log.Fatal("Failed to load certificate:", err)
+	}
+	return tlsCert
+}
+
+// tlsListener completes the TLS handshake of every connection before the
+// HTTP server sees it, so that the handshake can be timed. Handshakes run
+// concurrently and Accept returns the connections as they complete.
+type tlsListener struct {
+	net.Listener
+	config *tls.Config
+	conns  chan *tls.Conn
+	// done is closed by Close, failed once accepting failed permanently
+	// with err
+	done      chan struct{}
+	closeOnce sync.Once
+	failed    chan struct{}
+	err       error
+}
+
+// handshakeConn is the TCP connection under a tls.Conn of tlsListener. It
+// carries the handshake to the TcpCtx of the connection.
+type handshakeConn struct {
+	net.Conn
+	tls *TlsJson
+}
+
+func newTlsListener(listener net.Listener, config *tls.Config) *tlsListener {
+	l := &tlsListener{
+		Listener: listener,
+		config:   config,
+		conns:    make(chan *tls.Conn),
+		done:     make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *tlsListener) run() {
+	// like http.Server, temporary errors (e.g. EMFILE) are retried with a
+	// growing delay
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				log.Printf("tls accept failed, retrying in %s: %+v", delay, err)
+				select {
+				case <-time.After(delay):
+					continue
+				case <-l.done:
+				}
+			}
+			l.err = err
+			close(l.failed)
+			return
+		}
+		delay = 0
+		go l.handshake(conn)
+	}
+}
+
+func (l *tlsListener) handshake(conn net.Conn) {
+	startTime := time.Now()
+	hc := &handshakeConn{Conn: conn}
+	tlsConn := tls.Server(hc, l.config)
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	// the handshake is abandoned when the listener is closed
+	go func() {
+		select {
+		case <-l.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		log.Printf("tls handshake from %s failed: %+v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	hc.tls = newTlsJson(tlsConn.ConnectionState(), time.Since(startTime))
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		_ = tlsConn.Close()
+	}
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-l.failed:
+		return nil, l.err
+	}
+}
+
+// Close stops accepting and abandons the handshakes in progress.
+func (l *tlsListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// withTlsConn fills tcpCtx for a connection of tlsListener. The TCP info is
+// read from the socket under the TLS layer.
+func withTlsConn(tcpCtx *TcpCtx, conn *tls.Conn) {
+	tcpCtx.NativeConn = conn.NetConn()
+	if hc, ok := tcpCtx.NativeConn.(*handshakeConn); ok {
+		tcpCtx.NativeConn = hc.Conn
+		tcpCtx.Tls = hc.tls
+	}
+}
+
+func newTlsJson(state tls.ConnectionState, handshake time.Duration) *TlsJson {
+	return &TlsJson{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		Alpn:        state.NegotiatedProtocol,
+		Resumed:     state.DidResume,
+		HandshakeMs: float64(handshake.Microseconds()) / 1000,
+	}
+}
+
+// shortLivedCert holds a certificate of certutil.GenerateShortLivedCert and
+// renews it with the same key at half its validity, so that the hash
+// published by /api/certhash is never close to expiring.
+type shortLivedCert struct {
+	key      *ecdsa.PrivateKey
+	validity time.Duration
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	renewAt time.Time
+}
+
+func newShortLivedCert(validity time.Duration) (*shortLivedCert, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	c := &shortLivedCert{key: key, validity: validity}
+	if _, err := c.Current(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Current returns the certificate, renewing it when it is due.
+func (c *shortLivedCert) Current() (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && time.Now().Before(c.renewAt) {
+		return c.cert, nil
+	}
+	cert, err := certutil.GenerateShortLivedCert(c.key, c.validity)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	c.cert = &cert
+	c.renewAt = cert.Leaf.NotBefore.Add(c.validity / 2)
+	log.Printf("short-lived certificate valid until %s, hash %s", cert.Leaf.NotAfter.Format(time.RFC3339), certutil.GetCertificateHash(cert.Certificate[0]))
+	return c.cert, nil
+}
+
+func (c *shortLivedCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Current()
+}
+
+// newCertHashJson describes cert for WebTransport serverCertificateHashes.
+func newCertHashJson(cert *tls.Certificate) (*CertHashJson, error) {
+	leaf := cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	return &CertHashJson{
+		Algorithm: "sha-256",
+		Value:     certutil.GetCertificateHash(cert.Certificate[0]),
+		NotAfter:  leaf.NotAfter,
+		Pinnable:  certutil.IsHashPinnable(leaf),
+	}, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/sockopt"
+	"log"
+	"net"
+	"net/url"
+)
+
+// applyTuning applies the socket options requested in query to conn and
+// reads back what the kernel made of them. It returns nil when no tuning
+// was requested.
+//
+// The options are set after the handshake, so a larger rcvbuf can not raise
+// the window scale that was already negotiated.
+func applyTuning(conn net.Conn, query url.Values) *TuningJson {
+	opts, errs := sockopt.ParseQuery(query)
+	if opts.IsEmpty() && len(errs) == 0 {
+		return nil
+	}
+	return applySockOptions(conn, opts, errs)
+}
+
+// applySockOptions applies opts to conn and reads back the effective values.
+// errs are earlier errors to report along with the ones of Apply.
+func applySockOptions(conn net.Conn, opts *sockopt.Options, errs []error) *TuningJson {
+	tuning := &TuningJson{
+		Requested: opts,
+	}
+	if err := sockopt.Apply(conn, opts); err != nil {
+		errs = append(errs, err)
+	}
+	effective, err := sockopt.Read(conn)
+	if err != nil {
+		log.Printf("read socket options failed: %+v", err)
+	}
+	tuning.Effective = effective
+	for _, err := range errs {
+		tuning.Errors = append(tuning.Errors, err.Error())
+	}
+	return tuning
+}
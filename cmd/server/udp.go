@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/udpprobe"
+	"log"
+	"math"
+	"net"
+	"net/netip"
+	"time"
+)
+
+const (
+	maxUdpSessions = 1024
+	// udpSessionTimeout is how long a session is kept after its last packet,
+	// long enough to answer the retries of the End packet
+	udpSessionTimeout = 30 * time.Second
+	// udpSeqWindow is how far behind the highest sequence number packets
+	// are still checked for duplicates. The window has a fixed size, so that
+	// skipping sequence numbers costs the server nothing; older packets are
+	// counted as late instead of received.
+	udpSeqWindow = 4096
+	// udpReadBuffer absorbs the bursts of the paced senders, the default
+	// socket buffer drops packets at a few hundred Mbps
+	udpReadBuffer = 4 << 20
+)
+
+type udpSessionKey struct {
+	addr    netip.AddrPort
+	session uint64
+}
+
+// udpSession accumulates the statistics of one UDP test.
+type udpSession struct {
+	first, last time.Time
+	received    int64
+	bytes       int64
+	duplicates  int64
+	reordered   int64
+	late        int64
+	maxSeq      int64
+	// seen has the bit seq%udpSeqWindow set for every sequence number of
+	// the window (maxSeq-udpSeqWindow, maxSeq] that arrived
+	seen [udpSeqWindow / 64]uint64
+
+	// RFC 3550 interarrival jitter in nanoseconds
+	jitter      float64
+	lastTransit int64
+	hasTransit  bool
+
+	// result is set once the End packet arrived
+	result []byte
+}
+
+// serveUdp answers the UDP test (see pkg/udpprobe). All sessions are handled
+// on this goroutine, so they need no locking.
+func serveUdp(conn *net.UDPConn) error {
+	if err := conn.SetReadBuffer(udpReadBuffer); err != nil {
+		log.Printf("udp read buffer failed: %+v", err)
+	}
+	sessions := make(map[udpSessionKey]*udpSession)
+	lastSweep := time.Now()
+	buffer := make([]byte, udpprobe.MaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFromUDPAddrPort(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("udp read failed: %+v", err)
+			continue
+		}
+		now := time.Now()
+		if now.Sub(lastSweep) > time.Second {
+			for key, session := range sessions {
+				if now.Sub(session.last) > udpSessionTimeout {
+					delete(sessions, key)
+				}
+			}
+			lastSweep = now
+		}
+
+		header, err := udpprobe.Decode(buffer[:n])
+		if err != nil {
+			continue
+		}
+		key := udpSessionKey{addr: addr, session: header.Session}
+		session := sessions[key]
+		switch header.Type {
+		case udpprobe.TypeData:
+			if session == nil {
+				if len(sessions) >= maxUdpSessions {
+					continue
+				}
+				session = &udpSession{first: now, maxSeq: -1}
+				sessions[key] = session
+				log.Printf("udp test from %s", addr)
+			}
+			if session.result == nil {
+				session.record(header, n, now)
+			}
+		case udpprobe.TypeEnd:
+			if session == nil || n < udpprobe.EndSize {
+				continue
+			}
+			session.last = now
+			if session.result == nil {
+				result, err := session.finish(int64(header.Seq))
+				if err != nil {
+					log.Printf("udp result failed: %+v", err)
+					continue
+				}
+				session.result = result
+				log.Printf("udp result of %s: %s", addr, result[udpprobe.HeaderSize:])
+			}
+			if _, err := conn.WriteToUDPAddrPort(session.result, addr); err != nil {
+				log.Printf("udp write failed: %+v", err)
+			}
+		}
+	}
+}
+
+func (s *udpSession) record(header *udpprobe.Header, size int, now time.Time) {
+	s.last = now
+	if header.Seq > math.MaxInt64 {
+		return
+	}
+	seq := int64(header.Seq)
+	switch {
+	case seq > s.maxSeq:
+		// slide the window, forgetting the sequence numbers it leaves
+		if seq-s.maxSeq >= udpSeqWindow {
+			clear(s.seen[:])
+		} else {
+			for n := s.maxSeq + 1; n < seq; n++ {
+				s.setSeen(n, false)
+			}
+		}
+		s.setSeen(seq, true)
+		s.maxSeq = seq
+	case s.maxSeq-seq >= udpSeqWindow:
+		// it may as well be a duplicate, so it does not count as received
+		s.late++
+		return
+	case s.isSeen(seq):
+		s.duplicates++
+		return
+	default:
+		s.setSeen(seq, true)
+		s.reordered++
+	}
+
+	s.received++
+	s.bytes += int64(size)
+
+	// the clocks of both ends are not synchronized, but their offset cancels
+	// out in the difference of two transit times
+	transit := now.UnixNano() - header.SendTime
+	if s.hasTransit {
+		d := transit - s.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (float64(d) - s.jitter) / 16
+	}
+	s.lastTransit = transit
+	s.hasTransit = true
+}
+
+func (s *udpSession) isSeen(seq int64) bool {
+	i := seq % udpSeqWindow
+	return s.seen[i/64]&(1<<(i%64)) != 0
+}
+
+func (s *udpSession) setSeen(seq int64, seen bool) {
+	i := seq % udpSeqWindow
+	if seen {
+		s.seen[i/64] |= 1 << (i % 64)
+	} else {
+		s.seen[i/64] &^= 1 << (i % 64)
+	}
+}
+
+// finish encodes the Result packet for a test of sent Data packets.
+func (s *udpSession) finish(sent int64) ([]byte, error) {
+	elapsed := s.last.Sub(s.first)
+	result := &UdpResultJson{
+		Sent:       sent,
+		Received:   s.received,
+		Bytes:      s.bytes,
+		Lost:       max(sent-s.received, 0),
+		Duplicates: s.duplicates,
+		Reordered:  s.reordered,
+		Late:       s.late,
+		JitterMs:   s.jitter / float64(time.Millisecond),
+		ElapsedMs:  elapsed.Milliseconds(),
+	}
+	if sent > 0 {
+		result.LossPercent = float64(result.Lost) / float64(sent) * 100
+	}
+	if elapsed > 0 {
+		result.Throughput = float64(s.bytes*8) / elapsed.Seconds()
+	}
+
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, udpprobe.HeaderSize+len(encoded))
+	header := &udpprobe.Header{Type: udpprobe.TypeResult}
+	header.Encode(packet)
+	copy(packet[udpprobe.HeaderSize:], encoded)
+	if len(packet) > udpprobe.EndSize {
+		return nil, errors.New("result larger than the End packet")
+	}
+	return packet, nil
+}
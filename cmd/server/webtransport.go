@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/rawtcp"
+	"github.com/quic-go/webtransport-go"
+	"log"
+	"net/http"
+	"time"
+)
+
+const webTransportPath = "/api/webtransport"
+
+// errWebTransportTuning rejects socket options, a WebTransport stream shares
+// the UDP socket of the QUIC server
+var errWebTransportTuning = errors.New("socket tuning is not available over WebTransport")
+
+// webTransportHandler upgrades the request to a WebTransport session. Every
+// bidirectional stream the client opens in the session is a test of the raw
+// TCP protocol (see pkg/rawtcp), so a browser can run it without fetch.
+type webTransportHandler struct {
+	server *webtransport.Server
+}
+
+func (h *webTransportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	session, err := h.server.Upgrade(w, r)
+	if err != nil {
+		log.Printf("webtransport upgrade failed: %+v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	log.Printf("webtransport session from %s", session.RemoteAddr())
+
+	// the request context carries the QuicCtx of the connection
+	ctx := r.Context()
+	for {
+		stream, err := session.AcceptStream(session.Context())
+		if err != nil {
+			return
+		}
+		go handleWebTransportStream(ctx, stream)
+	}
+}
+
+func handleWebTransportStream(ctx context.Context, stream webtransport.Stream) {
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	_ = stream.SetReadDeadline(time.Now().Add(rawRequestTimeout))
+	var req rawtcp.Request
+	if err := rawtcp.ReadLine(reader, &req); err != nil {
+		log.Printf("webtransport request failed: %+v", err)
+		stream.CancelRead(0)
+		return
+	}
+	_ = stream.SetReadDeadline(time.Time{})
+
+	pattern, err := checkRawRequest(&req)
+	if err == nil && req.Tuning != nil && !req.Tuning.IsEmpty() {
+		err = errWebTransportTuning
+	}
+	if err != nil {
+		_ = rawtcp.WriteLine(stream, &rawtcp.Response{Error: err.Error()})
+		return
+	}
+	if err := rawtcp.WriteLine(stream, &rawtcp.Response{}); err != nil {
+		log.Printf("webtransport response failed: %+v", err)
+		return
+	}
+
+	switch req.Direction {
+	case rawtcp.DirectionDownload:
+		rawDownload(ctx, stream, &req, pattern)
+	case rawtcp.DirectionUpload:
+		rawUpload(ctx, stream, reader, &req)
+	}
+}
@@ -4,20 +4,23 @@ go 1.24
 
 require (
 	github.com/quic-go/quic-go v0.50.1
+	// no tagged release builds with quic-go v0.50.1: v0.8.0 uses the http3
+	// API from before quic-go v0.48 and v0.9.0 requires quic-go v0.53
+	github.com/quic-go/webtransport-go v0.8.1-0.20241018022711-4ac2c9250e66
+	golang.org/x/net v0.28.0
 	golang.org/x/sys v0.31.0
 )
 
 require (
 	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
-	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
-	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/google/pprof v0.0.0-20230821062121-407c9e7a662f // indirect
+	github.com/onsi/ginkgo/v2 v2.12.0 // indirect
 	github.com/quic-go/qpack v0.5.1 // indirect
 	go.uber.org/mock v0.5.0 // indirect
 	golang.org/x/crypto v0.26.0 // indirect
 	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
 	golang.org/x/mod v0.18.0 // indirect
-	golang.org/x/net v0.28.0 // indirect
 	golang.org/x/sync v0.8.0 // indirect
 	golang.org/x/text v0.17.0 // indirect
 	golang.org/x/tools v0.22.0 // indirect
@@ -0,0 +1,29 @@
+package certutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"time"
+)
+
+// MaxHashValidity is the longest validity of a certificate that browsers
+// accept by its hash (WebTransport serverCertificateHashes).
+const MaxHashValidity = 14 * 24 * time.Hour
+
+// GetCertificateHash returns the base64 SHA-256 of the DER certificate, the
+// value of a serverCertificateHashes entry.
+func GetCertificateHash(certBytes []byte) string {
+	h := sha256.Sum256(certBytes)
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// IsHashPinnable reports whether browsers accept cert by its hash: the key
+// must be ECDSA and the validity at most MaxHashValidity.
+func IsHashPinnable(cert *x509.Certificate) bool {
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok {
+		return false
+	}
+	return cert.NotAfter.Sub(cert.NotBefore) <= MaxHashValidity
+}
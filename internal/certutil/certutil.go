@@ -19,10 +19,31 @@ func GenerateSelfSignedCert() (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, fmt.Errorf("키 생성 실패: %w", err)
 	}
+	notBefore := time.Now().Add(-time.Hour)
+	return createSelfSignedCert(privateKey, big.NewInt(1), notBefore, notBefore.Add(365*24*time.Hour+time.Hour))
+}
+
+// GenerateShortLivedCert creates a self-signed certificate of key that is
+// valid for validity (at most MaxHashValidity), so that browsers accept it
+// by its hash without trusting it. Renewing with the same key keeps the SPKI
+// hash of the certificate.
+func GenerateShortLivedCert(key *ecdsa.PrivateKey, validity time.Duration) (tls.Certificate, error) {
+	if validity <= 0 || validity > MaxHashValidity {
+		return tls.Certificate{}, fmt.Errorf("validity must be between 0 and %s: %s", MaxHashValidity, validity)
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// 브라우저는 NotBefore부터 NotAfter까지의 기간을 검사하므로 clock skew 여유도 기간에 포함
+	notBefore := time.Now().Add(-time.Minute)
+	return createSelfSignedCert(key, serialNumber, notBefore, notBefore.Add(validity))
+}
 
+func createSelfSignedCert(privateKey *ecdsa.PrivateKey, serialNumber *big.Int, notBefore, notAfter time.Time) (tls.Certificate, error) {
 	// Create certificate template
 	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			Organization: []string{"HTTP3 Test Server"},
 			CommonName:   "localhost",
@@ -34,8 +55,8 @@ func GenerateSelfSignedCert() (tls.Certificate, error) {
 		DNSNames: []string{
 			"localhost",
 		},
-		NotBefore: time.Now().Add(-time.Hour),
-		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
 		KeyUsage:  x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage: []x509.ExtKeyUsage{
 			x509.ExtKeyUsageServerAuth,
@@ -0,0 +1,143 @@
+// Package footer frames the test result appended to the end of a download
+// body when HTTP trailers are not available.
+//
+// A footer is the payload followed by a fixed size tail:
+//
+//	payload | magic "TSPF" | version (1) | reserved (3) | length (4) | crc32 (4)
+//
+// Integers are big endian and crc32 is the IEEE checksum of the payload. The
+// tail is always the last TailSize bytes of the body, so a reader never has to
+// search the payload and only needs to keep the last MaxLength+TailSize bytes
+// of the stream.
+package footer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	Magic   = "TSPF"
+	Version = 1
+
+	// TailSize is the size of the fixed part at the end of a footer.
+	TailSize = 16
+	// MaxLength is the largest payload a footer can carry.
+	MaxLength = 1 << 20
+)
+
+var (
+	ErrNotFound  = errors.New("footer not found")
+	ErrTruncated = errors.New("footer truncated")
+	ErrChecksum  = errors.New("footer checksum mismatch")
+	ErrTooLarge  = errors.New("footer payload too large")
+)
+
+// Encode returns the footer carrying payload.
+func Encode(payload []byte) ([]byte, error) {
+	if len(payload) > MaxLength {
+		return nil, ErrTooLarge
+	}
+	out := make([]byte, len(payload)+TailSize)
+	copy(out, payload)
+
+	tail := out[len(payload):]
+	copy(tail[0:4], Magic)
+	tail[4] = Version
+	binary.BigEndian.PutUint32(tail[8:12], uint32(len(payload)))
+	binary.BigEndian.PutUint32(tail[12:16], crc32.ChecksumIEEE(payload))
+	return out, nil
+}
+
+// Decode returns the payload of the footer at the end of data, which is the
+// tail of a body. The returned slice aliases data.
+func Decode(data []byte) ([]byte, error) {
+	if len(data) < TailSize {
+		return nil, ErrNotFound
+	}
+	tail := data[len(data)-TailSize:]
+	if !bytes.Equal(tail[0:4], []byte(Magic)) {
+		return nil, ErrNotFound
+	}
+	if tail[4] != Version {
+		return nil, fmt.Errorf("unsupported footer version %d", tail[4])
+	}
+
+	length := binary.BigEndian.Uint32(tail[8:12])
+	if length > MaxLength {
+		return nil, ErrTooLarge
+	}
+	if int(length) > len(data)-TailSize {
+		return nil, ErrTruncated
+	}
+	payload := data[len(data)-TailSize-int(length) : len(data)-TailSize]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(tail[12:16]) {
+		return nil, ErrChecksum
+	}
+	return payload, nil
+}
+
+// TailBuffer is an io.Writer that keeps the last MaxLength+TailSize bytes
+// written to it, enough to decode any footer at the end of the stream.
+type TailBuffer struct {
+	// Out, if set, receives the bytes as they drop out of the tail, so
+	// that it sees the body without the footer once Flush is called.
+	Out io.Writer
+
+	buf []byte
+}
+
+func (t *TailBuffer) Write(p []byte) (int, error) {
+	const keep = MaxLength + TailSize
+	if len(p) >= keep {
+		if err := t.out(t.buf); err != nil {
+			return 0, err
+		}
+		if err := t.out(p[:len(p)-keep]); err != nil {
+			return 0, err
+		}
+		t.buf = append(t.buf[:0], p[len(p)-keep:]...)
+		return len(p), nil
+	}
+	// let the buffer grow to twice the window so the move is amortized
+	if len(t.buf)+len(p) > 2*keep {
+		drop := len(t.buf) + len(p) - keep
+		if err := t.out(t.buf[:drop]); err != nil {
+			return 0, err
+		}
+		t.buf = append(t.buf[:0], t.buf[drop:]...)
+	}
+	t.buf = append(t.buf, p...)
+	return len(p), nil
+}
+
+func (t *TailBuffer) out(p []byte) error {
+	if t.Out == nil || len(p) == 0 {
+		return nil
+	}
+	_, err := t.Out.Write(p)
+	return err
+}
+
+// Footer decodes the footer at the end of the bytes written so far.
+func (t *TailBuffer) Footer() ([]byte, error) {
+	return Decode(t.buf)
+}
+
+// Flush decodes the footer like Footer and writes the rest of the body that
+// precedes it to Out. Without a valid footer the whole tail is written.
+func (t *TailBuffer) Flush() ([]byte, error) {
+	payload, err := t.Footer()
+	body := t.buf
+	if err == nil {
+		body = t.buf[:len(t.buf)-len(payload)-TailSize]
+	}
+	if werr := t.out(body); werr != nil && err == nil {
+		err = werr
+	}
+	return payload, err
+}
@@ -0,0 +1,142 @@
+package footer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	for _, payload := range [][]byte{
+		{},
+		[]byte(`{"bytes":1}`),
+		bytes.Repeat([]byte("x"), MaxLength),
+	} {
+		encoded, err := Encode(payload)
+		if err != nil {
+			t.Fatalf("Encode(%d bytes): %v", len(payload), err)
+		}
+		if len(encoded) != len(payload)+TailSize {
+			t.Fatalf("Encode(%d bytes) returned %d bytes", len(payload), len(encoded))
+		}
+		body := append([]byte("body before the footer"), encoded...)
+		decoded, err := Decode(body)
+		if err != nil {
+			t.Fatalf("Decode(%d bytes): %v", len(payload), err)
+		}
+		if !bytes.Equal(decoded, payload) {
+			t.Fatalf("Decode returned %d bytes, want %d", len(decoded), len(payload))
+		}
+	}
+}
+
+func TestEncodeTooLarge(t *testing.T) {
+	if _, err := Encode(make([]byte, MaxLength+1)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Encode error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid, err := Encode([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// modify returns a copy of the valid footer changed by f
+	modify := func(f func(b []byte)) []byte {
+		b := bytes.Clone(valid)
+		f(b)
+		return b
+	}
+	tail := len(valid) - TailSize
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNotFound},
+		{"shorter than the tail", valid[len(valid)-TailSize+1:], ErrNotFound},
+		{"no magic", bytes.Repeat([]byte{0}, 64), ErrNotFound},
+		{"payload cut off", valid[2:], ErrTruncated},
+		{"length larger than the body", modify(func(b []byte) {
+			binary.BigEndian.PutUint32(b[tail+8:], uint32(len(b)))
+		}), ErrTruncated},
+		{"length over the maximum", modify(func(b []byte) {
+			binary.BigEndian.PutUint32(b[tail+8:], MaxLength+1)
+		}), ErrTooLarge},
+		{"corrupt payload", modify(func(b []byte) { b[0] ^= 1 }), ErrChecksum},
+		{"corrupt checksum", modify(func(b []byte) { b[len(b)-1] ^= 1 }), ErrChecksum},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.data); !errors.Is(err, tt.want) {
+				t.Fatalf("Decode error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("unsupported version", func(t *testing.T) {
+		data := modify(func(b []byte) { b[tail+4] = Version + 1 })
+		if _, err := Decode(data); err == nil {
+			t.Fatal("Decode accepted an unknown version")
+		}
+	})
+}
+
+func TestTailBuffer(t *testing.T) {
+	encoded, err := Encode([]byte(`{"result":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		bodySize  int
+		chunkSize int
+	}{
+		{"no body", 0, 7},
+		{"small body", 100, 7},
+		{"body larger than the window", 3*(MaxLength+TailSize) + 5, 64 * 1024},
+		{"single write larger than the window", 2*(MaxLength+TailSize) + 3, 3 * (MaxLength + TailSize)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := make([]byte, tt.bodySize)
+			for i := range body {
+				body[i] = byte(i)
+			}
+			stream := append(bytes.Clone(body), encoded...)
+
+			var out bytes.Buffer
+			tb := &TailBuffer{Out: &out}
+			for off := 0; off < len(stream); off += tt.chunkSize {
+				if _, err := tb.Write(stream[off:min(off+tt.chunkSize, len(stream))]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			payload, err := tb.Flush()
+			if err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+			if string(payload) != `{"result":true}` {
+				t.Fatalf("Flush payload = %q", payload)
+			}
+			if !bytes.Equal(out.Bytes(), body) {
+				t.Fatalf("Out received %d bytes, want the %d bytes of the body", out.Len(), len(body))
+			}
+		})
+	}
+}
+
+func TestTailBufferWithoutFooter(t *testing.T) {
+	var out bytes.Buffer
+	tb := &TailBuffer{Out: &out}
+	_, _ = tb.Write([]byte("no footer here"))
+	if _, err := tb.Flush(); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Flush error = %v, want %v", err, ErrNotFound)
+	}
+	if out.String() != "no footer here" {
+		t.Fatalf("Out = %q, want the whole tail", out.String())
+	}
+}
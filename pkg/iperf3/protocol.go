@@ -0,0 +1,224 @@
+// Package iperf3 implements the wire format of the iperf3 control protocol,
+// so that unmodified iperf3 clients can test against our server.
+//
+// A test starts with a control connection on which the client sends its
+// cookie. The server then drives the test by sending state bytes:
+//
+//   - PARAM_EXCHANGE: the client sends its parameters as JSON
+//   - CREATE_STREAMS: the client opens the data connections, each of which
+//     starts with the cookie of the test
+//   - TEST_START, TEST_RUNNING: data flows until the client sends TEST_END
+//   - EXCHANGE_RESULTS: the client sends its results, then the server its own
+//   - DISPLAY_RESULTS: the client answers with IPERF_DONE
+//
+// JSON messages are prefixed with their length as a 4 byte big endian
+// integer.
+package iperf3
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	DefaultPort = 5201
+
+	// CookieSize is the size of the cookie including its terminating NUL.
+	CookieSize = 37
+	// MaxJsonSize bounds the JSON messages read from the client.
+	MaxJsonSize = 1 << 20
+	// MaxStreams is the largest number of parallel streams iperf3 allows.
+	MaxStreams = 128
+)
+
+// State is the signed state byte of the control connection.
+type State int8
+
+const (
+	StateTestStart       State = 1
+	StateTestRunning     State = 2
+	StateTestEnd         State = 4
+	StateParamExchange   State = 9
+	StateCreateStreams   State = 10
+	StateServerTerminate State = 11
+	StateClientTerminate State = 12
+	StateExchangeResults State = 13
+	StateDisplayResults  State = 14
+	StateIperfDone       State = 16
+	StateAccessDenied    State = -1
+	StateServerError     State = -2
+)
+
+// Errno is the iperf3 error number (i_errno) sent after StateServerError.
+type Errno int32
+
+const (
+	ErrnoDuration      Errno = 5
+	ErrnoNumStreams    Errno = 6
+	ErrnoBlockSize     Errno = 7
+	ErrnoUnimplemented Errno = 13
+)
+
+// Params are the test parameters sent by the client. Fields the server does
+// not act on are left out.
+type Params struct {
+	Tcp             bool   `json:"tcp,omitempty"`
+	Udp             bool   `json:"udp,omitempty"`
+	Sctp            bool   `json:"sctp,omitempty"`
+	Omit            int    `json:"omit,omitempty"`
+	Time            int    `json:"time,omitempty"`
+	Num             int64  `json:"num,omitempty"`
+	BlockCount      int64  `json:"blockcount,omitempty"`
+	Mss             int    `json:"MSS,omitempty"`
+	NoDelay         bool   `json:"nodelay,omitempty"`
+	Parallel        int    `json:"parallel,omitempty"`
+	Reverse         bool   `json:"reverse,omitempty"`
+	Bidirectional   bool   `json:"bidirectional,omitempty"`
+	Window          int    `json:"window,omitempty"`
+	Len             int    `json:"len,omitempty"`
+	Bandwidth       uint64 `json:"bandwidth,omitempty"`
+	FqRate          uint64 `json:"fqrate,omitempty"`
+	Congestion      string `json:"congestion,omitempty"`
+	GetServerOutput int    `json:"get_server_output,omitempty"`
+	AuthToken       string `json:"authtoken,omitempty"`
+	ClientVersion   string `json:"client_version,omitempty"`
+}
+
+// Results are exchanged by both sides at the end of a test. CPU utilization
+// is in percent.
+type Results struct {
+	CpuUtilTotal  float64 `json:"cpu_util_total"`
+	CpuUtilUser   float64 `json:"cpu_util_user"`
+	CpuUtilSystem float64 `json:"cpu_util_system"`
+	// SenderHasRetransmits is 1 when the sender reports retransmits, 0 when
+	// it can not and -1 from the receiver
+	SenderHasRetransmits int            `json:"sender_has_retransmits"`
+	CongestionUsed       string         `json:"congestion_used,omitempty"`
+	Streams              []StreamResult `json:"streams"`
+	ServerOutputText     string         `json:"server_output_text,omitempty"`
+}
+
+// StreamResult is the result of a single stream. The UDP counters are
+// required by the clients even for TCP tests. Times are in seconds.
+type StreamResult struct {
+	Id             int     `json:"id"`
+	Bytes          int64   `json:"bytes"`
+	Retransmits    int64   `json:"retransmits"`
+	Jitter         float64 `json:"jitter"`
+	Errors         int64   `json:"errors"`
+	OmittedErrors  int64   `json:"omitted_errors"`
+	Packets        int64   `json:"packets"`
+	OmittedPackets int64   `json:"omitted_packets"`
+	StartTime      float64 `json:"start_time"`
+	EndTime        float64 `json:"end_time"`
+}
+
+// StreamId returns the id iperf3 gives the n-th stream (from 0) of a test.
+// The numbering skips 2 for historical reasons, and the clients match the
+// results by id.
+func StreamId(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return n + 2
+}
+
+// ReadCookie reads the cookie that starts every connection.
+func ReadCookie(r io.Reader) (string, error) {
+	var cookie [CookieSize]byte
+	if _, err := io.ReadFull(r, cookie[:]); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(cookie[:], "\x00")), nil
+}
+
+func ReadState(r io.Reader) (State, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return State(int8(b[0])), nil
+}
+
+func WriteState(w io.Writer, state State) error {
+	_, err := w.Write([]byte{byte(state)})
+	return err
+}
+
+// WriteServerError rejects the test with the iperf3 error number errno. The
+// second number is the errno of the C library, which we never have.
+func WriteServerError(w io.Writer, errno Errno) error {
+	var buf [9]byte
+	state := StateServerError
+	buf[0] = byte(state)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(errno))
+	_, err := w.Write(buf[:])
+	return err
+}
+
+// ReadJson reads a length prefixed JSON message into v.
+func ReadJson(r io.Reader, v interface{}) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if n > MaxJsonSize {
+		return errors.New("json message too large")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("invalid json message: %w", err)
+	}
+	return nil
+}
+
+// WriteJson writes v as a length prefixed JSON message.
+func WriteJson(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], data)
+	_, err = w.Write(buf)
+	return err
+}
+
+func (s State) String() string {
+	switch s {
+	case StateTestStart:
+		return "TEST_START"
+	case StateTestRunning:
+		return "TEST_RUNNING"
+	case StateTestEnd:
+		return "TEST_END"
+	case StateParamExchange:
+		return "PARAM_EXCHANGE"
+	case StateCreateStreams:
+		return "CREATE_STREAMS"
+	case StateServerTerminate:
+		return "SERVER_TERMINATE"
+	case StateClientTerminate:
+		return "CLIENT_TERMINATE"
+	case StateExchangeResults:
+		return "EXCHANGE_RESULTS"
+	case StateDisplayResults:
+		return "DISPLAY_RESULTS"
+	case StateIperfDone:
+		return "IPERF_DONE"
+	case StateAccessDenied:
+		return "ACCESS_DENIED"
+	case StateServerError:
+		return "SERVER_ERROR"
+	}
+	return fmt.Sprintf("state %d", int8(s))
+}
@@ -0,0 +1,131 @@
+// Package payload generates the data sent by speed tests.
+package payload
+
+import (
+	crand "crypto/rand"
+	"fmt"
+	"io"
+	randv2 "math/rand/v2"
+	"strconv"
+)
+
+// Pattern selects what the payload looks like. Only PatternRandom is neither
+// compressible nor deduplicable; the others are there to detect middleboxes
+// that compress or deduplicate traffic, which makes them faster than random.
+type Pattern string
+
+const (
+	PatternRandom Pattern = "random"
+	PatternZeros  Pattern = "zeros"
+	// PatternText repeats a short line of text
+	PatternText Pattern = "text"
+	// PatternDedup repeats a random block that is larger than a deflate
+	// window, so it can only be reduced by deduplication
+	PatternDedup Pattern = "dedup"
+	// PatternJson is a stream of JSON records with random values
+	PatternJson Pattern = "json"
+)
+
+var Patterns = []Pattern{PatternRandom, PatternZeros, PatternText, PatternDedup, PatternJson}
+
+const dedupBlockSize = 64 * 1024
+
+const textLine = "The quick brown fox jumps over the lazy dog. 0123456789\n"
+
+// ParsePattern returns the pattern with the given name, PatternRandom if the
+// name is empty.
+func ParsePattern(name string) (Pattern, error) {
+	if name == "" {
+		return PatternRandom, nil
+	}
+	for _, p := range Patterns {
+		if string(p) == name {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pattern: %s", name)
+}
+
+// NewReader returns an endless reader producing the pattern.
+func NewReader(pattern Pattern) (io.Reader, error) {
+	var seed [32]byte
+	_, _ = crand.Read(seed[:])
+	rnd := randv2.NewChaCha8(seed)
+
+	switch pattern {
+	case PatternRandom:
+		return rnd, nil
+	case PatternZeros:
+		return zeroReader{}, nil
+	case PatternText:
+		return &repeatReader{block: []byte(textLine)}, nil
+	case PatternDedup:
+		block := make([]byte, dedupBlockSize)
+		_, _ = rnd.Read(block)
+		return &repeatReader{block: block}, nil
+	case PatternJson:
+		return &jsonReader{rnd: randv2.New(rnd)}, nil
+	}
+	return nil, fmt.Errorf("unknown pattern: %s", pattern)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// repeatReader repeats block forever.
+type repeatReader struct {
+	block []byte
+	off   int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		c := copy(p[n:], r.block[r.off:])
+		n += c
+		r.off = (r.off + c) % len(r.block)
+	}
+	return n, nil
+}
+
+// jsonReader produces records one at a time and hands them out across reads.
+type jsonReader struct {
+	rnd     *randv2.Rand
+	id      uint64
+	pending []byte
+	buf     []byte
+}
+
+func (r *jsonReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.pending) == 0 {
+			r.pending = r.next()
+		}
+		c := copy(p[n:], r.pending)
+		n += c
+		r.pending = r.pending[c:]
+	}
+	return n, nil
+}
+
+func (r *jsonReader) next() []byte {
+	r.id++
+	b := r.buf[:0]
+	b = append(b, `{"id":`...)
+	b = strconv.AppendUint(b, r.id, 10)
+	b = append(b, `,"user":"user-`...)
+	b = strconv.AppendUint(b, r.rnd.Uint64N(10000), 10)
+	b = append(b, `","active":`...)
+	b = strconv.AppendBool(b, r.rnd.IntN(2) == 0)
+	b = append(b, `,"score":`...)
+	b = strconv.AppendFloat(b, r.rnd.Float64()*100, 'f', 2, 64)
+	b = append(b, `,"tags":["speed","test"]}`...)
+	b = append(b, ",\n"...)
+	r.buf = b
+	return b
+}
@@ -0,0 +1,163 @@
+package payload
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// MaxChunkSize is the largest chunk a Source hands out at once.
+const MaxChunkSize = 1 << 20
+
+// Source hands out the payload of a transfer in chunks.
+type Source interface {
+	// Chunk returns n bytes (at most MaxChunkSize) of payload at offset
+	// off. The returned slice must not be modified and is only valid until
+	// the next call.
+	Chunk(off int64, n int) []byte
+}
+
+// streamSource reads chunks from a reader in sequence, ignoring offsets.
+type streamSource struct {
+	r   io.Reader
+	buf []byte
+}
+
+// NewStreamSource returns a Source that reads every chunk from r in order.
+func NewStreamSource(r io.Reader) Source {
+	return &streamSource{r: r, buf: make([]byte, MaxChunkSize)}
+}
+
+func (s *streamSource) Chunk(_ int64, n int) []byte {
+	_, _ = io.ReadFull(s.r, s.buf[:n])
+	return s.buf[:n]
+}
+
+// Pool is a pre-generated, read-only block of a pattern shared by all
+// requests, so that producing the payload costs nothing but the copy into
+// the socket. The payload repeats every Size bytes.
+//
+// On Linux the block lives in a memfd, which lets Open hand out files for
+// sendfile.
+type Pool struct {
+	pattern Pattern
+	size    int
+	// data is size+MaxChunkSize bytes, the tail repeats the head so that
+	// every chunk is contiguous
+	data []byte
+	// path reopens the memfd with an independent file offset, empty if
+	// the platform has no memfd
+	path string
+}
+
+// NewPool generates a pool of size bytes of the pattern.
+func NewPool(pattern Pattern, size int) (*Pool, error) {
+	if size < MaxChunkSize {
+		size = MaxChunkSize
+	}
+	r, err := NewReader(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Pool{pattern: pattern, size: size}
+	if err := p.alloc(); err != nil {
+		return nil, err
+	}
+	_, _ = r.Read(p.data[:size])
+	copy(p.data[size:], p.data[:MaxChunkSize])
+	if err := p.seal(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Pool) Pattern() Pattern {
+	return p.pattern
+}
+
+func (p *Pool) Size() int {
+	return p.size
+}
+
+// Chunk returns n bytes of the pool starting at off modulo Size.
+func (p *Pool) Chunk(off int64, n int) []byte {
+	start := int(off % int64(p.size))
+	return p.data[start : start+n : start+n]
+}
+
+// keySize is the length of the key of a keyed Source.
+const keySize = 64 * 1024
+
+// keyedSource XORs the chunks of a pool with a key of its own.
+type keyedSource struct {
+	pool *Pool
+	key  []byte
+	buf  []byte
+}
+
+// Keyed returns a Source of the pool XORed with a random key, so that no two
+// transfers send the same bytes. A random pool must only be sent keyed: a
+// deduplicating WAN optimizer would learn the shared pool after the first
+// test and speed up the random baseline too. XOR costs a fraction of
+// generating fresh random data.
+func (p *Pool) Keyed() Source {
+	s := &keyedSource{
+		pool: p,
+		key:  make([]byte, keySize),
+		buf:  make([]byte, MaxChunkSize),
+	}
+	_, _ = crand.Read(s.key)
+	return s
+}
+
+func (s *keyedSource) Chunk(off int64, n int) []byte {
+	data := s.pool.Chunk(off, n)
+	buf := s.buf[:n]
+	for i := 0; i < n; {
+		k := int((off + int64(i)) % keySize)
+		i += subtle.XORBytes(buf[i:], data[i:], s.key[k:])
+	}
+	return buf
+}
+
+// Open returns a new read-only file holding the pool (Size()+MaxChunkSize
+// bytes) with its own file offset, for use with sendfile. It returns
+// errors.ErrUnsupported where the pool is not backed by a file.
+func (p *Pool) Open() (*os.File, error) {
+	if p.path == "" {
+		return nil, errors.ErrUnsupported
+	}
+	return os.Open(p.path)
+}
+
+// PoolSet creates the pools of every pattern on first use.
+type PoolSet struct {
+	size  int
+	mu    sync.Mutex
+	pools map[Pattern]*Pool
+}
+
+func NewPoolSet(size int) *PoolSet {
+	return &PoolSet{
+		size:  size,
+		pools: make(map[Pattern]*Pool),
+	}
+}
+
+func (s *PoolSet) Get(pattern Pattern) (*Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pool, ok := s.pools[pattern]; ok {
+		return pool, nil
+	}
+	pool, err := NewPool(pattern, s.size)
+	if err != nil {
+		return nil, err
+	}
+	s.pools[pattern] = pool
+	return pool, nil
+}
@@ -0,0 +1,44 @@
+package payload
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+)
+
+// alloc maps a memfd so the pool is shared between the process and sendfile
+// without a second copy.
+func (p *Pool) alloc() error {
+	length := p.size + MaxChunkSize
+	fd, err := unix.MemfdCreate("payload-"+string(p.pattern), unix.MFD_CLOEXEC)
+	if err != nil {
+		return p.allocHeap()
+	}
+	if err := unix.Ftruncate(fd, int64(length)); err != nil {
+		_ = unix.Close(fd)
+		return p.allocHeap()
+	}
+	data, err := unix.Mmap(fd, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		_ = unix.Close(fd)
+		return p.allocHeap()
+	}
+	// the fd is kept open for the lifetime of the process, Open reopens it
+	// through procfs to get an independent offset
+	p.data = data
+	p.path = fmt.Sprintf("/proc/self/fd/%d", fd)
+	return nil
+}
+
+// allocHeap is the fallback for kernels without memfd or mmap failures.
+func (p *Pool) allocHeap() error {
+	p.data = make([]byte, p.size+MaxChunkSize)
+	p.path = ""
+	return nil
+}
+
+func (p *Pool) seal() error {
+	if p.path == "" {
+		return nil
+	}
+	return unix.Mprotect(p.data, unix.PROT_READ)
+}
@@ -0,0 +1,37 @@
+package payload
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyed(t *testing.T) {
+	pool, err := NewPool(PatternRandom, MaxChunkSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read reads n bytes from off in chunks of chunkSize
+	read := func(src Source, off int64, n int, chunkSize int) []byte {
+		var out []byte
+		for len(out) < n {
+			c := min(chunkSize, n-len(out))
+			out = append(out, src.Chunk(off+int64(len(out)), c)...)
+		}
+		return out
+	}
+
+	// crosses the end of the key and of the pool
+	const off, n = MaxChunkSize - keySize - 100, keySize + 200
+	src := pool.Keyed()
+	whole := read(src, off, n, n)
+	if chunked := read(src, off, n, 333); !bytes.Equal(whole, chunked) {
+		t.Fatal("the payload depends on the chunk size")
+	}
+	if bytes.Equal(whole, read(pool, off, n, n)) {
+		t.Fatal("the keyed payload is the pool itself")
+	}
+	if bytes.Equal(whole, read(pool.Keyed(), off, n, n)) {
+		t.Fatal("two keyed sources sent the same payload")
+	}
+}
@@ -0,0 +1,112 @@
+package payload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	randv2 "math/rand/v2"
+)
+
+// Integrity is what one side of a seeded transfer saw. Verified,
+// MismatchOffset and Truncated are only set by the receiving side: Verified
+// when every byte of the whole transfer matched the seeded stream, otherwise
+// MismatchOffset is the offset of the first byte that did not, or with
+// Truncated the offset where the stream ended early.
+type Integrity struct {
+	Seed           string `json:"seed"`
+	Bytes          int64  `json:"bytes"`
+	Sha256         string `json:"sha256"`
+	Verified       bool   `json:"verified,omitempty"`
+	MismatchOffset *int64 `json:"mismatchOffset,omitempty"`
+	Truncated      bool   `json:"truncated,omitempty"`
+}
+
+// NewSeededReader returns the endless random stream of seed. Both ends of a
+// test derive the same stream from the same seed.
+func NewSeededReader(seed string) io.Reader {
+	return randv2.NewChaCha8(sha256.Sum256([]byte(seed)))
+}
+
+// Hasher hashes the seeded stream on the sending side.
+type Hasher struct {
+	seed  string
+	bytes int64
+	hash  hash.Hash
+}
+
+func NewHasher(seed string) *Hasher {
+	return &Hasher{seed: seed, hash: sha256.New()}
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	h.bytes += int64(len(p))
+	return h.hash.Write(p)
+}
+
+func (h *Hasher) Integrity() *Integrity {
+	return &Integrity{
+		Seed:   h.seed,
+		Bytes:  h.bytes,
+		Sha256: hex.EncodeToString(h.hash.Sum(nil)),
+	}
+}
+
+// Verifier compares the received stream with the seeded stream as it
+// arrives and hashes it.
+type Verifier struct {
+	Hasher
+	expected io.Reader
+	buf      []byte
+	mismatch int64
+}
+
+func NewVerifier(seed string) *Verifier {
+	return &Verifier{
+		Hasher:   *NewHasher(seed),
+		expected: NewSeededReader(seed),
+		mismatch: -1,
+	}
+}
+
+func (v *Verifier) Write(p []byte) (int, error) {
+	// after the first mismatch the rest is only hashed
+	if v.mismatch < 0 {
+		if cap(v.buf) < len(p) {
+			v.buf = make([]byte, len(p))
+		}
+		expected := v.buf[:len(p)]
+		_, _ = v.expected.Read(expected)
+		if !bytes.Equal(expected, p) {
+			for i := range p {
+				if p[i] != expected[i] {
+					v.mismatch = v.bytes + int64(i)
+					break
+				}
+			}
+		}
+	}
+	return v.Hasher.Write(p)
+}
+
+// Integrity reports what was received. expected is the length of the
+// transfer, -1 if it is not known; a stream of another length is not
+// verified even if every byte it carried matched.
+func (v *Verifier) Integrity(expected int64) *Integrity {
+	integrity := v.Hasher.Integrity()
+	offset := v.mismatch
+	switch {
+	case offset >= 0:
+	case expected >= 0 && v.bytes < expected:
+		offset = v.bytes
+		integrity.Truncated = true
+	case expected >= 0 && v.bytes > expected:
+		offset = expected
+	default:
+		integrity.Verified = true
+		return integrity
+	}
+	integrity.MismatchOffset = &offset
+	return integrity
+}
@@ -0,0 +1,90 @@
+package payload
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func seeded(seed string, n int) []byte {
+	data := make([]byte, n)
+	_, _ = io.ReadFull(NewSeededReader(seed), data)
+	return data
+}
+
+func TestVerifier(t *testing.T) {
+	const size = 100000
+	tests := []struct {
+		name string
+		// corrupt flips the bytes at these offsets
+		corrupt   []int
+		chunkSize int
+		// received is how many of the size bytes arrive
+		received  int
+		mismatch  int64
+		truncated bool
+	}{
+		{"intact", nil, 4096, size, -1, false},
+		{"first byte", []int{0}, 4096, size, 0, false},
+		{"inside a chunk", []int{5000}, 4096, size, 5000, false},
+		{"chunk boundary", []int{8192}, 4096, size, 8192, false},
+		{"only the first is reported", []int{70000, 30000, 90000}, 1000, size, 30000, false},
+		{"last byte", []int{size - 1}, 333, size, size - 1, false},
+		{"truncated", nil, 4096, 60000, 60000, true},
+		{"nothing received", nil, 4096, 0, 0, true},
+		{"corrupt before the truncation", []int{100}, 4096, 60000, 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := seeded("seed", size)[:tt.received]
+			for _, off := range tt.corrupt {
+				data[off] ^= 0xff
+			}
+
+			verifier := NewVerifier("seed")
+			for off := 0; off < len(data); off += tt.chunkSize {
+				_, _ = verifier.Write(data[off:min(off+tt.chunkSize, len(data))])
+			}
+			integrity := verifier.Integrity(size)
+
+			if integrity.Bytes != int64(tt.received) {
+				t.Errorf("Bytes = %d, want %d", integrity.Bytes, tt.received)
+			}
+			if tt.mismatch < 0 {
+				if !integrity.Verified || integrity.MismatchOffset != nil {
+					t.Fatalf("intact stream not verified: %+v", integrity)
+				}
+				return
+			}
+			if integrity.Verified {
+				t.Fatal("corrupt stream verified")
+			}
+			if integrity.MismatchOffset == nil || *integrity.MismatchOffset != tt.mismatch {
+				t.Fatalf("MismatchOffset = %v, want %d", integrity.MismatchOffset, tt.mismatch)
+			}
+			if integrity.Truncated != tt.truncated {
+				t.Fatalf("Truncated = %v, want %v", integrity.Truncated, tt.truncated)
+			}
+		})
+	}
+}
+
+func TestVerifierHashMatchesSender(t *testing.T) {
+	data := seeded("abc", 12345)
+	hasher := NewHasher("abc")
+	_, _ = hasher.Write(data)
+	verifier := NewVerifier("abc")
+	_, _ = verifier.Write(data)
+	if sent, received := hasher.Integrity(), verifier.Integrity(int64(len(data))); sent.Sha256 != received.Sha256 {
+		t.Fatalf("sha256 of the sender %s differs from the receiver %s", sent.Sha256, received.Sha256)
+	}
+}
+
+func TestSeededReaderIsReproducible(t *testing.T) {
+	if !bytes.Equal(seeded("x", 1000), seeded("x", 1000)) {
+		t.Fatal("the same seed produced different streams")
+	}
+	if bytes.Equal(seeded("x", 1000), seeded("y", 1000)) {
+		t.Fatal("different seeds produced the same stream")
+	}
+}
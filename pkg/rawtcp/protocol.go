@@ -0,0 +1,94 @@
+// Package rawtcp is a minimal throughput protocol over plain TCP, for
+// measuring the TCP path without HTTP framing.
+//
+// The client sends a Request as a single JSON line and the server answers
+// with a Response line. If the request was accepted:
+//
+//   - download: the server streams payload until the size or the duration is
+//     reached, appends its result JSON as a footer (see pkg/footer) and
+//     closes the connection.
+//   - upload: the client streams payload and half-closes the connection; the
+//     server answers with its result JSON and closes the connection.
+package rawtcp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/sockopt"
+	"io"
+	"time"
+)
+
+const Version = 1
+
+// MaxLineSize bounds the request and response lines.
+const MaxLineSize = 64 * 1024
+
+type Direction string
+
+const (
+	// DirectionDownload sends from the server to the client
+	DirectionDownload Direction = "download"
+	// DirectionUpload sends from the client to the server
+	DirectionUpload Direction = "upload"
+)
+
+// Request describes the test. Size is in bytes and only used when
+// DurationMs is zero. BufferSize is the size of each read or write call.
+// Pattern, Seed and Tuning have the meaning of the HTTP query parameters of
+// the same name.
+type Request struct {
+	Version    int              `json:"version"`
+	Direction  Direction        `json:"direction"`
+	DurationMs int64            `json:"durationMs,omitempty"`
+	Size       int64            `json:"size,omitempty"`
+	BufferSize int              `json:"bufferSize,omitempty"`
+	SampleMs   int64            `json:"sampleMs,omitempty"`
+	Pattern    string           `json:"pattern,omitempty"`
+	Seed       string           `json:"seed,omitempty"`
+	Tuning     *sockopt.Options `json:"tuning,omitempty"`
+}
+
+func (r *Request) Duration() time.Duration {
+	return time.Duration(r.DurationMs) * time.Millisecond
+}
+
+// Response accepts the request, or rejects it with Error.
+type Response struct {
+	Error string `json:"error,omitempty"`
+}
+
+// WriteLine writes v as a single JSON line.
+func WriteLine(w io.Writer, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// ReadLine reads a single JSON line into v. The reader must be buffered by
+// the caller because it may read past the line.
+func ReadLine(r *bufio.Reader, v interface{}) error {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return err
+		}
+		line = append(line, chunk...)
+		if len(line) > MaxLineSize {
+			return errors.New("line too long")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		return fmt.Errorf("invalid line: %w", err)
+	}
+	return nil
+}
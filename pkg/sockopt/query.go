@@ -0,0 +1,46 @@
+package sockopt
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ParseQuery reads the socket tuning query parameters of a test request:
+// cc, sndbuf, rcvbuf, notsent_lowat, maxseg, window_clamp and
+// max_pacing_rate (bytes/sec).
+func ParseQuery(query url.Values) (*Options, []error) {
+	opts := &Options{}
+	var errs []error
+
+	parseInt := func(name string) *int {
+		v := query.Get(name)
+		if v == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			return nil
+		}
+		return &n
+	}
+
+	if cc := query.Get("cc"); cc != "" {
+		opts.CongestionControl = &cc
+	}
+	opts.SndBuf = parseInt("sndbuf")
+	opts.RcvBuf = parseInt("rcvbuf")
+	opts.NotsentLowat = parseInt("notsent_lowat")
+	opts.MaxSeg = parseInt("maxseg")
+	opts.WindowClamp = parseInt("window_clamp")
+	if v := query.Get("max_pacing_rate"); v != "" {
+		rate, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("max_pacing_rate: %w", err))
+		} else {
+			opts.MaxPacingRate = &rate
+		}
+	}
+	return opts, errs
+}
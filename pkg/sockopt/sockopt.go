@@ -0,0 +1,24 @@
+package sockopt
+
+// Options are the per connection TCP socket options that can be tuned for a
+// test. Nil fields are left untouched by Apply.
+type Options struct {
+	CongestionControl *string `json:"cc,omitempty"`
+	SndBuf            *int    `json:"sndbuf,omitempty"`
+	RcvBuf            *int    `json:"rcvbuf,omitempty"`
+	NotsentLowat      *int    `json:"notsentLowat,omitempty"`
+	MaxSeg            *int    `json:"maxseg,omitempty"`
+	WindowClamp       *int    `json:"windowClamp,omitempty"`
+	// MaxPacingRate is in bytes/sec
+	MaxPacingRate *uint64 `json:"maxPacingRate,omitempty"`
+}
+
+func (o *Options) IsEmpty() bool {
+	return o.CongestionControl == nil &&
+		o.SndBuf == nil &&
+		o.RcvBuf == nil &&
+		o.NotsentLowat == nil &&
+		o.MaxSeg == nil &&
+		o.WindowClamp == nil &&
+		o.MaxPacingRate == nil
+}
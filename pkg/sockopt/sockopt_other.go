@@ -0,0 +1,96 @@
+//go:build !windows
+// +build !windows
+
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+// Apply sets every non-nil option on the socket of conn. Options that the
+// kernel rejects are reported in the returned error; the others still apply.
+func Apply(conn net.Conn, opts *Options) error {
+	rawConn, err := tcpinfo.SyscallConn(conn)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	err = rawConn.Control(func(fd uintptr) {
+		s := int(fd)
+		setInt := func(name string, v *int, level, opt int) {
+			if v == nil {
+				return
+			}
+			if err := unix.SetsockoptInt(s, level, opt, *v); err != nil {
+				errs = append(errs, fmt.Errorf("%s=%d: %w", name, *v, err))
+			}
+		}
+
+		if opts.CongestionControl != nil {
+			if err := unix.SetsockoptString(s, unix.IPPROTO_TCP, unix.TCP_CONGESTION, *opts.CongestionControl); err != nil {
+				errs = append(errs, fmt.Errorf("cc=%s: %w", *opts.CongestionControl, err))
+			}
+		}
+		setInt("sndbuf", opts.SndBuf, unix.SOL_SOCKET, unix.SO_SNDBUF)
+		setInt("rcvbuf", opts.RcvBuf, unix.SOL_SOCKET, unix.SO_RCVBUF)
+		setInt("notsent_lowat", opts.NotsentLowat, unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT)
+		setInt("maxseg", opts.MaxSeg, unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+		setInt("window_clamp", opts.WindowClamp, unix.IPPROTO_TCP, unix.TCP_WINDOW_CLAMP)
+		if opts.MaxPacingRate != nil {
+			if err := unix.SetsockoptUint64(s, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, *opts.MaxPacingRate); err != nil {
+				errs = append(errs, fmt.Errorf("max_pacing_rate=%d: %w", *opts.MaxPacingRate, err))
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("control function error: %w", err)
+	}
+	return errors.Join(errs...)
+}
+
+// Read returns the effective values of all options as reported by getsockopt.
+func Read(conn net.Conn) (*Options, error) {
+	rawConn, err := tcpinfo.SyscallConn(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &Options{}
+	var errs []error
+	err = rawConn.Control(func(fd uintptr) {
+		s := int(fd)
+		getInt := func(name string, level, opt int) *int {
+			v, err := unix.GetsockoptInt(s, level, opt)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return nil
+			}
+			return &v
+		}
+
+		if cc, err := unix.GetsockoptString(s, unix.IPPROTO_TCP, unix.TCP_CONGESTION); err != nil {
+			errs = append(errs, fmt.Errorf("cc: %w", err))
+		} else {
+			opts.CongestionControl = &cc
+		}
+		opts.SndBuf = getInt("sndbuf", unix.SOL_SOCKET, unix.SO_SNDBUF)
+		opts.RcvBuf = getInt("rcvbuf", unix.SOL_SOCKET, unix.SO_RCVBUF)
+		opts.NotsentLowat = getInt("notsent_lowat", unix.IPPROTO_TCP, unix.TCP_NOTSENT_LOWAT)
+		opts.MaxSeg = getInt("maxseg", unix.IPPROTO_TCP, unix.TCP_MAXSEG)
+		opts.WindowClamp = getInt("window_clamp", unix.IPPROTO_TCP, unix.TCP_WINDOW_CLAMP)
+		if rate, err := unix.GetsockoptUint64(s, unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE); err != nil {
+			errs = append(errs, fmt.Errorf("max_pacing_rate: %w", err))
+		} else {
+			opts.MaxPacingRate = &rate
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("control function error: %w", err)
+	}
+	return opts, errors.Join(errs...)
+}
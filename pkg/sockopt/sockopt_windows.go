@@ -0,0 +1,74 @@
+package sockopt
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jclab-joseph/tcp-speed-problem-test/pkg/tcpinfo"
+	"net"
+	"syscall"
+)
+
+// Apply sets the socket buffer sizes of conn. The other options have no
+// Windows equivalent and are reported as unsupported.
+func Apply(conn net.Conn, opts *Options) error {
+	rawConn, err := tcpinfo.SyscallConn(conn)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	unsupported := func(name string, set bool) {
+		if set {
+			errs = append(errs, fmt.Errorf("%s: %w", name, errors.ErrUnsupported))
+		}
+	}
+	unsupported("cc", opts.CongestionControl != nil)
+	unsupported("notsent_lowat", opts.NotsentLowat != nil)
+	unsupported("maxseg", opts.MaxSeg != nil)
+	unsupported("window_clamp", opts.WindowClamp != nil)
+	unsupported("max_pacing_rate", opts.MaxPacingRate != nil)
+
+	err = rawConn.Control(func(fd uintptr) {
+		setInt := func(name string, v *int, opt int) {
+			if v == nil {
+				return
+			}
+			if err := syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, *v); err != nil {
+				errs = append(errs, fmt.Errorf("%s=%d: %w", name, *v, err))
+			}
+		}
+		setInt("sndbuf", opts.SndBuf, syscall.SO_SNDBUF)
+		setInt("rcvbuf", opts.RcvBuf, syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return fmt.Errorf("control function error: %w", err)
+	}
+	return errors.Join(errs...)
+}
+
+// Read returns the effective socket buffer sizes of conn.
+func Read(conn net.Conn) (*Options, error) {
+	rawConn, err := tcpinfo.SyscallConn(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &Options{}
+	var errs []error
+	err = rawConn.Control(func(fd uintptr) {
+		getInt := func(name string, opt int) *int {
+			v, err := syscall.GetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				return nil
+			}
+			return &v
+		}
+		opts.SndBuf = getInt("sndbuf", syscall.SO_SNDBUF)
+		opts.RcvBuf = getInt("rcvbuf", syscall.SO_RCVBUF)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("control function error: %w", err)
+	}
+	return opts, errors.Join(errs...)
+}
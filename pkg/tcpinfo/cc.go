@@ -0,0 +1,36 @@
+package tcpinfo
+
+// CongestionInfo is the active congestion control algorithm of a connection
+// and, for algorithms that export it through TCP_CC_INFO, its internal state.
+type CongestionInfo struct {
+	Name  string     `json:"name"`
+	Bbr   *BBRInfo   `json:"bbr,omitempty"`
+	Dctcp *DCTCPInfo `json:"dctcp,omitempty"`
+	Vegas *VegasInfo `json:"vegas,omitempty"`
+}
+
+// BBRInfo is struct tcp_bbr_info. Gains are fixed point numbers scaled by 256.
+type BBRInfo struct {
+	// Bw is the estimated bottleneck bandwidth in bytes/sec
+	Bw         uint64 `json:"bw"`
+	MinRttUs   uint32 `json:"minRtt"`
+	PacingGain uint32 `json:"pacingGain"`
+	CwndGain   uint32 `json:"cwndGain"`
+}
+
+// DCTCPInfo is struct tcp_dctcp_info.
+type DCTCPInfo struct {
+	Enabled bool   `json:"enabled"`
+	CeState uint16 `json:"ceState"`
+	Alpha   uint32 `json:"alpha"`
+	AbEcn   uint32 `json:"abEcn"`
+	AbTot   uint32 `json:"abTot"`
+}
+
+// VegasInfo is struct tcpvegas_info.
+type VegasInfo struct {
+	Enabled  bool   `json:"enabled"`
+	RttCnt   uint32 `json:"rttCnt"`
+	RttUs    uint32 `json:"rtt"`
+	MinRttUs uint32 `json:"minRtt"`
+}
@@ -0,0 +1,27 @@
+package tcpinfo
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// maxUnwrapDepth guards against wrappers returning themselves from NetConn.
+const maxUnwrapDepth = 16
+
+// SyscallConn returns the raw socket behind conn. Connections that do not
+// implement syscall.Conn themselves (tls.Conn, application wrappers, ...) are
+// unwrapped through their NetConn() method.
+func SyscallConn(conn net.Conn) (syscall.RawConn, error) {
+	for i := 0; i < maxUnwrapDepth && conn != nil; i++ {
+		if sc, ok := conn.(syscall.Conn); ok {
+			return sc.SyscallConn()
+		}
+		nc, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = nc.NetConn()
+	}
+	return nil, errors.New("no tcp conn")
+}
@@ -0,0 +1,246 @@
+package tcpinfo
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+)
+
+// Bottleneck is the factor that limited the throughput of a connection.
+type Bottleneck string
+
+const (
+	// BottleneckNetwork means no local limit was found: the sender was
+	// congestion window limited, so the path itself set the pace.
+	BottleneckNetwork        Bottleneck = "network"
+	BottleneckReceiverWindow Bottleneck = "rwnd_limited"
+	BottleneckSendBuffer     Bottleneck = "sndbuf_limited"
+	BottleneckApplication    Bottleneck = "app_limited"
+	BottleneckLoss           Bottleneck = "loss"
+	BottleneckRtoStorm       Bottleneck = "rto_storm"
+	BottleneckReordering     Bottleneck = "reordering"
+	BottleneckPmtu           Bottleneck = "pmtu"
+)
+
+// Finding is a single factor that contributed to the diagnosis. Severity is
+// between 0 and 1.
+type Finding struct {
+	Bottleneck  Bottleneck `json:"bottleneck"`
+	Severity    float64    `json:"severity"`
+	Explanation string     `json:"explanation"`
+}
+
+// Diagnosis is the result of Diagnose. Verdict is the most severe finding,
+// Findings lists every factor that was detected, most severe first.
+// Unchecked lists the factors that could not be evaluated because the kernel
+// does not report the counters they depend on.
+type Diagnosis struct {
+	Verdict     Bottleneck   `json:"verdict"`
+	Explanation string       `json:"explanation"`
+	Findings    []Finding    `json:"findings,omitempty"`
+	Unchecked   []Bottleneck `json:"unchecked,omitempty"`
+}
+
+const (
+	limitedThreshold      = 0.2
+	retransRateThreshold  = 0.01
+	rtoStormThreshold     = 3
+	reordSeenThreshold    = 10
+	dsackDupsThreshold    = 3
+	minPathMtu            = 1280
+	appLimitedThreshold   = 0.5
+	receiverWindowSatRate = 0.8
+)
+
+// Diagnose classifies what limited a transfer of throughputBps (bits/sec)
+// from the final TCP info snapshot and, when available, a sampler series.
+// It works from either end of the connection, but the sender side snapshot
+// carries far more evidence than the receiver side one. Fields listed in
+// info.Unsupported are never taken as evidence.
+func Diagnose(info *Info, samples []Sample, throughputBps float64) *Diagnosis {
+	var findings []Finding
+	var unchecked []Bottleneck
+	// supported reports whether every field is provided, otherwise the
+	// bottleneck is recorded as unchecked
+	supported := func(bottleneck Bottleneck, fields ...string) bool {
+		for _, field := range fields {
+			if !info.Supported(field) {
+				if !slices.Contains(unchecked, bottleneck) {
+					unchecked = append(unchecked, bottleneck)
+				}
+				return false
+			}
+		}
+		return true
+	}
+	add := func(bottleneck Bottleneck, severity float64, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Bottleneck:  bottleneck,
+			Severity:    math.Min(severity, 1),
+			Explanation: fmt.Sprintf(format, args...),
+		})
+	}
+
+	sender, known := direction(info)
+	if !known {
+		unchecked = append(unchecked, BottleneckReceiverWindow, BottleneckSendBuffer, BottleneckLoss, BottleneckApplication)
+	}
+
+	if known && sender {
+		rwndSupported := supported(BottleneckReceiverWindow, "busyTime", "rwndLimited")
+		sndbufSupported := supported(BottleneckSendBuffer, "busyTime", "sndbufLimited")
+		busy := float64(info.BusyTimeUs)
+		if frac := float64(info.RwndLimitedUs) / busy; rwndSupported && busy > 0 && frac >= limitedThreshold {
+			add(BottleneckReceiverWindow, frac,
+				"the sender was limited by the receive window advertised by the peer %.0f%% of the time; "+
+					"the peer's receive buffer (net.ipv4.tcp_rmem, SO_RCVBUF) is smaller than the bandwidth-delay product (%s)",
+				frac*100, formatBytes(bdp(throughputBps, info.RttUs)))
+		}
+		if frac := float64(info.SndbufLimitedUs) / busy; sndbufSupported && busy > 0 && frac >= limitedThreshold {
+			add(BottleneckSendBuffer, frac,
+				"the sender ran out of send buffer %.0f%% of the time; "+
+					"increase net.ipv4.tcp_wmem or SO_SNDBUF above the bandwidth-delay product (%s)",
+				frac*100, formatBytes(bdp(throughputBps, info.RttUs)))
+		}
+	}
+
+	if known && !sender && supported(BottleneckReceiverWindow, "rcvWnd") && info.RcvWnd > 0 && info.RttUs > 0 {
+		// throughput can not exceed rcv_wnd / rtt, so a receiver that keeps
+		// delivering close to that rate is holding the sender back
+		windowRate := float64(info.RcvWnd) * 8 / (float64(info.RttUs) / 1e6)
+		if rate := throughputBps / windowRate; rate >= receiverWindowSatRate {
+			add(BottleneckReceiverWindow, rate,
+				"the measured throughput is %.0f%% of what the advertised receive window of %s allows at an RTT of %d us; "+
+					"increase net.ipv4.tcp_rmem or SO_RCVBUF on this side",
+				rate*100, formatBytes(uint64(info.RcvWnd)), info.RttUs)
+		}
+	}
+
+	// kernels without bytes_retrans still count retransmitted segments
+	retrans := info.BytesRetrans
+	if !info.Supported("bytesRetrans") {
+		retrans = uint64(info.Retransmits) * uint64(info.Mss)
+	}
+	if sent := sentBytes(info); known && sender && sent > 0 {
+		rate := float64(retrans) / float64(sent)
+		if rate >= retransRateThreshold {
+			explanation := fmt.Sprintf("%.2f%% of the sent bytes were retransmitted", rate*100)
+			if info.Mss > 0 && info.RttUs > 0 {
+				// Mathis et al.: rate <= MSS / RTT * 1.22 / sqrt(p)
+				mathis := float64(info.Mss) * 8 / (float64(info.RttUs) / 1e6) * 1.22 / math.Sqrt(rate)
+				explanation += fmt.Sprintf("; at this loss rate TCP Reno/CUBIC can reach about %s", formatBps(mathis))
+			}
+			add(BottleneckLoss, rate*10, "%s", explanation)
+		}
+	}
+
+	if supported(BottleneckRtoStorm, "timeouts") && info.Timeouts >= rtoStormThreshold {
+		add(BottleneckRtoStorm, 0.5+float64(info.Timeouts)/20,
+			"%d retransmission timeouts occurred; each one collapses the congestion window to one segment, "+
+				"which points to heavy loss bursts or a path that drops all packets for a while", info.Timeouts)
+	}
+
+	if !info.Supported("reordSeen") && !info.Supported("dsackDups") {
+		unchecked = append(unchecked, BottleneckReordering)
+	} else if info.ReordSeen >= reordSeenThreshold || (info.DsackDups >= dsackDupsThreshold && info.DsackDups*2 >= info.Retransmits) {
+		add(BottleneckReordering, 0.3,
+			"the path reorders packets (%d reordering events, %d spurious retransmits reported by DSACK); "+
+				"reordering is mistaken for loss and shrinks the congestion window",
+			info.ReordSeen, info.DsackDups)
+	}
+
+	if !supported(BottleneckPmtu, "pmtu") {
+		// without the path MTU there is nothing to check
+	} else if info.Pmtu > 0 && info.Pmtu < minPathMtu {
+		add(BottleneckPmtu, 0.6,
+			"the path MTU is only %d bytes, which multiplies the per-packet overhead; "+
+				"check for tunnels, or an MTU black hole if timeouts are also reported", info.Pmtu)
+	} else if info.Pmtu > 0 && info.Pmtu < 1500 && info.Timeouts > 0 && info.Mss < 1200 {
+		add(BottleneckPmtu, 0.5,
+			"retransmission timeouts together with a reduced MSS of %d bytes suggest an MTU black hole "+
+				"(ICMP \"fragmentation needed\" messages dropped on the path)", info.Mss)
+	}
+
+	if known && sender && len(samples) > 0 && supported(BottleneckApplication, "notsentBytes") {
+		var idle int
+		for _, sample := range samples {
+			window := sample.Cwnd
+			if sample.SndWnd > 0 && sample.SndWnd < window {
+				window = sample.SndWnd
+			}
+			if sample.NotsentBytes == 0 && sample.BytesInFlight < window/2 {
+				idle++
+			}
+		}
+		if frac := float64(idle) / float64(len(samples)); frac >= appLimitedThreshold {
+			add(BottleneckApplication, frac,
+				"the send queue was empty and less than half of the usable window was in flight in %.0f%% of the samples; "+
+					"the application did not produce data fast enough", frac*100)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Severity > findings[j].Severity
+	})
+
+	diagnosis := &Diagnosis{Findings: findings, Unchecked: unchecked}
+	if len(findings) > 0 {
+		diagnosis.Verdict = findings[0].Bottleneck
+		diagnosis.Explanation = findings[0].Explanation
+	} else {
+		diagnosis.Verdict = BottleneckNetwork
+		diagnosis.Explanation = fmt.Sprintf(
+			"no local limit was detected; %s is what the path and the congestion control delivered", formatBps(throughputBps))
+		if len(unchecked) > 0 {
+			diagnosis.Explanation += fmt.Sprintf("; %v could not be checked because the kernel does not report their counters", unchecked)
+		}
+	}
+	return diagnosis
+}
+
+// direction reports whether info was taken on the sending side of the
+// transfer, using only the byte counters the kernel provides. Kernels before
+// 4.19 have no bytes_sent, but bytes_acked is close enough. known is false
+// when neither can be compared with the received bytes.
+func direction(info *Info) (sender bool, known bool) {
+	if !info.Supported("bytesIn") || (!info.Supported("bytesOut") && !info.Supported("bytesAcked")) {
+		return false, false
+	}
+	sent := sentBytes(info)
+	if sent == 0 && info.BytesIn == 0 {
+		return false, false
+	}
+	return sent >= info.BytesIn, true
+}
+
+// sentBytes returns bytesOut, or bytesAcked where bytesOut is not provided.
+func sentBytes(info *Info) uint64 {
+	if info.Supported("bytesOut") {
+		return info.BytesOut
+	}
+	if info.Supported("bytesAcked") {
+		return info.BytesAcked
+	}
+	return 0
+}
+
+// bdp returns the bandwidth-delay product in bytes.
+func bdp(throughputBps float64, rttUs uint32) uint64 {
+	return uint64(throughputBps / 8 * float64(rttUs) / 1e6)
+}
+
+func formatBytes(n uint64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+func formatBps(bps float64) string {
+	return fmt.Sprintf("%.2f Mbps", bps/1000000)
+}
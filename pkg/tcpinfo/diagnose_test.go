@@ -0,0 +1,150 @@
+package tcpinfo
+
+import (
+	"slices"
+	"testing"
+)
+
+// sender returns the info of a clean 10 MiB upload: 1 ms RTT, no loss and
+// no limit
+func sender() *Info {
+	return &Info{
+		State:      StateEstablished,
+		Mss:        1448,
+		RttUs:      1000,
+		MinRttUs:   900,
+		Cwnd:       100 * 1448,
+		SndWnd:     4 << 20,
+		RcvWnd:     64 << 10,
+		BytesIn:    200,
+		BytesOut:   10 << 20,
+		BytesAcked: 10 << 20,
+		Pmtu:       1500,
+		BusyTimeUs: 1000000,
+	}
+}
+
+// receiver returns the other end of the transfer of sender
+func receiver() *Info {
+	info := sender()
+	info.BytesIn, info.BytesOut, info.BytesAcked = 10<<20, 200, 200
+	info.RcvWnd = 4 << 20
+	return info
+}
+
+func TestDiagnose(t *testing.T) {
+	tests := []struct {
+		name       string
+		info       func() *Info
+		samples    []Sample
+		throughput float64
+		want       Bottleneck
+	}{
+		{"clean sender", sender, nil, 100e6, BottleneckNetwork},
+		{"clean receiver", receiver, nil, 100e6, BottleneckNetwork},
+		{"receive window of the peer", func() *Info {
+			info := sender()
+			info.RwndLimitedUs = 600000
+			return info
+		}, nil, 100e6, BottleneckReceiverWindow},
+		{"receive window of this side", func() *Info {
+			info := receiver()
+			// 64 KiB per ms is 524 Mbps
+			info.RcvWnd = 64 << 10
+			return info
+		}, nil, 500e6, BottleneckReceiverWindow},
+		{"send buffer", func() *Info {
+			info := sender()
+			info.SndbufLimitedUs = 500000
+			return info
+		}, nil, 100e6, BottleneckSendBuffer},
+		{"loss", func() *Info {
+			info := sender()
+			info.BytesRetrans = info.BytesOut / 20
+			return info
+		}, nil, 100e6, BottleneckLoss},
+		{"rto storm", func() *Info {
+			info := sender()
+			info.Timeouts = 10
+			return info
+		}, nil, 100e6, BottleneckRtoStorm},
+		{"reordering", func() *Info {
+			info := sender()
+			info.ReordSeen = 50
+			return info
+		}, nil, 100e6, BottleneckReordering},
+		{"small path mtu", func() *Info {
+			info := sender()
+			info.Pmtu = 1000
+			return info
+		}, nil, 100e6, BottleneckPmtu},
+		{"mtu black hole", func() *Info {
+			info := sender()
+			info.Pmtu, info.Mss, info.Timeouts = 1400, 1000, 1
+			return info
+		}, nil, 100e6, BottleneckPmtu},
+		{"application", sender, []Sample{
+			{Cwnd: 100000, SndWnd: 1 << 20, BytesInFlight: 1000},
+			{Cwnd: 100000, SndWnd: 1 << 20, BytesInFlight: 2000},
+			{Cwnd: 100000, SndWnd: 1 << 20, BytesInFlight: 90000, NotsentBytes: 1000},
+		}, 100e6, BottleneckApplication},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnosis := Diagnose(tt.info(), tt.samples, tt.throughput)
+			if diagnosis.Verdict != tt.want {
+				t.Fatalf("Verdict = %s (%s), want %s", diagnosis.Verdict, diagnosis.Explanation, tt.want)
+			}
+			if len(diagnosis.Unchecked) > 0 {
+				t.Errorf("Unchecked = %v with every field supported", diagnosis.Unchecked)
+			}
+		})
+	}
+}
+
+func TestDiagnoseUnsupported(t *testing.T) {
+	// kernels 4.1 to 4.18 report bytes_received and bytes_acked, but not
+	// bytes_sent and the fields added with it
+	oldKernel := []string{"bytesOut", "bytesRetrans", "deliveryRate", "busyTime", "rwndLimited", "sndbufLimited", "timeouts", "reordSeen", "dsackDups"}
+
+	t.Run("direction from bytes acked", func(t *testing.T) {
+		info := sender()
+		info.BytesOut = 0
+		info.Unsupported = oldKernel
+		// retransmitted segments stand in for the retransmitted bytes
+		info.Retransmits = uint32(info.BytesAcked / 20 / uint64(info.Mss))
+		diagnosis := Diagnose(info, nil, 100e6)
+		if diagnosis.Verdict != BottleneckLoss {
+			t.Fatalf("Verdict = %s (%s), want %s", diagnosis.Verdict, diagnosis.Explanation, BottleneckLoss)
+		}
+	})
+
+	t.Run("unsupported fields are not evidence", func(t *testing.T) {
+		info := sender()
+		info.BytesOut, info.BusyTimeUs = 0, 0
+		info.Unsupported = oldKernel
+		diagnosis := Diagnose(info, nil, 100e6)
+		if diagnosis.Verdict != BottleneckNetwork {
+			t.Fatalf("Verdict = %s, want %s", diagnosis.Verdict, BottleneckNetwork)
+		}
+		for _, bottleneck := range []Bottleneck{BottleneckReceiverWindow, BottleneckSendBuffer, BottleneckRtoStorm, BottleneckReordering} {
+			if !slices.Contains(diagnosis.Unchecked, bottleneck) {
+				t.Errorf("Unchecked = %v, missing %s", diagnosis.Unchecked, bottleneck)
+			}
+		}
+	})
+
+	t.Run("unknown direction", func(t *testing.T) {
+		info := sender()
+		info.BytesOut, info.BytesAcked = 0, 0
+		info.RwndLimitedUs = 900000
+		info.Unsupported = []string{"bytesOut", "bytesAcked"}
+		diagnosis := Diagnose(info, nil, 100e6)
+		if diagnosis.Verdict != BottleneckNetwork {
+			t.Fatalf("Verdict = %s, want %s without a known direction", diagnosis.Verdict, BottleneckNetwork)
+		}
+		if !slices.Contains(diagnosis.Unchecked, BottleneckReceiverWindow) {
+			t.Errorf("Unchecked = %v, missing %s", diagnosis.Unchecked, BottleneckReceiverWindow)
+		}
+	})
+}
@@ -0,0 +1,74 @@
+package tcpinfo
+
+import "slices"
+
+// State is the platform independent name of a TCP connection state.
+type State string
+
+const (
+	StateUnknown     State = "UNKNOWN"
+	StateEstablished State = "ESTABLISHED"
+	StateSynSent     State = "SYN_SENT"
+	StateSynRecv     State = "SYN_RECV"
+	StateFinWait1    State = "FIN_WAIT1"
+	StateFinWait2    State = "FIN_WAIT2"
+	StateTimeWait    State = "TIME_WAIT"
+	StateClose       State = "CLOSE"
+	StateCloseWait   State = "CLOSE_WAIT"
+	StateLastAck     State = "LAST_ACK"
+	StateListen      State = "LISTEN"
+	StateClosing     State = "CLOSING"
+)
+
+// Info is a normalized snapshot of the kernel TCP statistics of a connection.
+//
+// Units are the same on every platform: times are in microseconds and
+// windows are in bytes. Raw holds the platform specific structure
+// (*LinuxTCPInfo on Linux, *TCPInfoV0 on Windows) for fields that have no
+// portable equivalent.
+//
+// Fields listed in Unsupported (by JSON name) were not provided by the
+// running kernel and are zero without being measured.
+type Info struct {
+	State    State  `json:"state"`
+	Mss      uint32 `json:"mss"`
+	RttUs    uint32 `json:"rtt"`
+	MinRttUs uint32 `json:"minRtt"`
+	Cwnd     uint32 `json:"cwnd"`
+	SndWnd   uint32 `json:"sndWnd"`
+	RcvWnd   uint32 `json:"rcvWnd"`
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	// BytesAcked counts the sent bytes the peer acknowledged; kernels
+	// before 4.19 report it but not BytesOut
+	BytesAcked   uint64 `json:"bytesAcked"`
+	BytesRetrans uint64 `json:"bytesRetrans"`
+	Retransmits  uint32 `json:"retransmits"`
+	RcvSpace     uint32 `json:"rcvSpace"`
+	DeliveryRate uint64 `json:"deliveryRate"`
+	NotsentBytes uint32 `json:"notsentBytes"`
+
+	BytesInFlight   uint32 `json:"bytesInFlight"`
+	Pmtu            uint32 `json:"pmtu"`
+	BusyTimeUs      uint64 `json:"busyTime"`
+	RwndLimitedUs   uint64 `json:"rwndLimited"`
+	SndbufLimitedUs uint64 `json:"sndbufLimited"`
+	// Timeouts counts retransmission timeouts (RTO episodes)
+	Timeouts uint32 `json:"timeouts"`
+	// ReordSeen counts reordering events seen by the sender
+	ReordSeen uint32 `json:"reordSeen"`
+	// DsackDups counts segments reported as duplicates, i.e. spurious retransmits
+	DsackDups uint32 `json:"dsackDups"`
+
+	// Congestion is nil when the platform does not expose the algorithm
+	Congestion *CongestionInfo `json:"congestion,omitempty"`
+
+	Unsupported []string    `json:"unsupported,omitempty"`
+	Raw         interface{} `json:"-"`
+}
+
+// Supported reports whether the field with the given JSON name was provided
+// by the platform.
+func (i *Info) Supported(field string) bool {
+	return !slices.Contains(i.Unsupported, field)
+}
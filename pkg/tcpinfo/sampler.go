@@ -0,0 +1,106 @@
+package tcpinfo
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Sample is a single point of a Sampler time series.
+type Sample struct {
+	// TimeMs is the time since Sampler.Start in milliseconds
+	TimeMs        int64  `json:"t"`
+	Cwnd          uint32 `json:"cwnd"`
+	RttUs         uint32 `json:"rtt"`
+	RcvSpace      uint32 `json:"rcvSpace"`
+	DeliveryRate  uint64 `json:"deliveryRate"`
+	Retransmits   uint32 `json:"retransmits"`
+	NotsentBytes  uint32 `json:"notsentBytes"`
+	BytesInFlight uint32 `json:"bytesInFlight"`
+	SndWnd        uint32 `json:"sndWnd"`
+}
+
+// Sampler polls the TCP info of a connection at a fixed interval.
+type Sampler struct {
+	conn     net.Conn
+	interval time.Duration
+
+	mu      sync.Mutex
+	start   time.Time
+	samples []Sample
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+func NewSampler(conn net.Conn, interval time.Duration) *Sampler {
+	return &Sampler{
+		conn:     conn,
+		interval: interval,
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+func (s *Sampler) Start() {
+	s.start = time.Now()
+	go s.run()
+}
+
+// Stop takes a last sample, stops polling and returns the series.
+func (s *Sampler) Stop() []Sample {
+	close(s.stopCh)
+	<-s.doneCh
+	return s.Samples()
+}
+
+func (s *Sampler) Samples() []Sample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Sample(nil), s.samples...)
+}
+
+func (s *Sampler) run() {
+	defer close(s.doneCh)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	s.sample()
+	for {
+		select {
+		case <-s.stopCh:
+			s.sample()
+			return
+		case <-ticker.C:
+			if !s.sample() {
+				return
+			}
+		}
+	}
+}
+
+func (s *Sampler) sample() bool {
+	info, err := GetTcpInfo(s.conn)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	s.samples = append(s.samples, NewSample(time.Since(s.start), info))
+	s.mu.Unlock()
+	return true
+}
+
+func NewSample(elapsed time.Duration, info *Info) Sample {
+	return Sample{
+		TimeMs:        elapsed.Milliseconds(),
+		Cwnd:          info.Cwnd,
+		RttUs:         info.RttUs,
+		RcvSpace:      info.RcvSpace,
+		DeliveryRate:  info.DeliveryRate,
+		Retransmits:   info.Retransmits,
+		NotsentBytes:  info.NotsentBytes,
+		BytesInFlight: info.BytesInFlight,
+		SndWnd:        info.SndWnd,
+	}
+}
@@ -4,29 +4,196 @@
 package tcpinfo
 
 import (
-	"errors"
+	"fmt"
 	"golang.org/x/sys/unix"
-	"log"
 	"net"
+	"reflect"
+	"unsafe"
 )
 
-func GetTcpInfo(conn net.Conn) (*unix.TCPInfo, error) {
-	// Get TCP info before closing
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		file, err := tcpConn.File()
-		if err != nil {
-			log.Printf("Error getting file descriptor: %v", err)
-			return nil, err
+// LinuxTCPInfo is struct tcp_info together with the number of bytes the
+// running kernel filled in. Older kernels return a shorter structure, so the
+// fields past Len are zero because they were never measured.
+type LinuxTCPInfo struct {
+	unix.TCPInfo
+	Len int
+}
+
+var tcpInfoType = reflect.TypeOf(unix.TCPInfo{})
+
+// Has reports whether the kernel filled in the named unix.TCPInfo field.
+func (i *LinuxTCPInfo) Has(field string) bool {
+	f, ok := tcpInfoType.FieldByName(field)
+	if !ok {
+		return false
+	}
+	return f.Offset+f.Type.Size() <= uintptr(i.Len)
+}
+
+// normalizedSources maps the Info fields that newer kernels added to
+// struct tcp_info onto the raw field they are read from.
+var normalizedSources = []struct {
+	name string
+	raw  string
+}{
+	{"minRtt", "Min_rtt"},
+	{"sndWnd", "Snd_wnd"},
+	{"rcvWnd", "Rcv_wnd"},
+	{"bytesIn", "Bytes_received"},
+	{"bytesOut", "Bytes_sent"},
+	{"bytesAcked", "Bytes_acked"},
+	{"bytesRetrans", "Bytes_retrans"},
+	{"deliveryRate", "Delivery_rate"},
+	{"notsentBytes", "Notsent_bytes"},
+	{"busyTime", "Busy_time"},
+	{"rwndLimited", "Rwnd_limited"},
+	{"sndbufLimited", "Sndbuf_limited"},
+	{"timeouts", "Total_rto"},
+	{"reordSeen", "Reord_seen"},
+	{"dsackDups", "Dsack_dups"},
+}
+
+var linuxStates = map[uint8]State{
+	1:  StateEstablished,
+	2:  StateSynSent,
+	3:  StateSynRecv,
+	4:  StateFinWait1,
+	5:  StateFinWait2,
+	6:  StateTimeWait,
+	7:  StateClose,
+	8:  StateCloseWait,
+	9:  StateLastAck,
+	10: StateListen,
+	11: StateClosing,
+}
+
+func GetTcpInfo(conn net.Conn) (*Info, error) {
+	rawConn, err := SyscallConn(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *LinuxTCPInfo
+	var congestion *CongestionInfo
+	var infoErr error
+	err = rawConn.Control(func(fd uintptr) {
+		info, infoErr = getsockoptTCPInfo(int(fd))
+		if infoErr == nil {
+			congestion = getCongestionInfo(int(fd))
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("control function error: %w", err)
+	}
+	if infoErr != nil {
+		return nil, fmt.Errorf("getsockopt TCP_INFO error: %w", infoErr)
+	}
+
+	result := newInfo(info)
+	result.Congestion = congestion
+	return result, nil
+}
+
+// getsockoptTCPInfo is unix.GetsockoptTCPInfo that keeps the returned length.
+func getsockoptTCPInfo(fd int) (*LinuxTCPInfo, error) {
+	info := &LinuxTCPInfo{}
+	vallen := uint32(unix.SizeofTCPInfo)
+	_, _, errno := unix.Syscall6(
+		unix.SYS_GETSOCKOPT,
+		uintptr(fd),
+		unix.IPPROTO_TCP,
+		unix.TCP_INFO,
+		uintptr(unsafe.Pointer(&info.TCPInfo)),
+		uintptr(unsafe.Pointer(&vallen)),
+		0,
+	)
+	if errno != 0 {
+		return nil, errno
+	}
+	info.Len = int(vallen)
+	return info, nil
+}
+
+// getCongestionInfo reads TCP_CONGESTION and the matching TCP_CC_INFO.
+// Algorithms without TCP_CC_INFO support only report their name.
+func getCongestionInfo(fd int) *CongestionInfo {
+	name, err := unix.GetsockoptString(fd, unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	if err != nil {
+		return nil
+	}
+
+	congestion := &CongestionInfo{Name: name}
+	switch name {
+	case "bbr", "bbr2", "bbr3":
+		if raw, err := unix.GetsockoptTCPCCBBRInfo(fd, unix.IPPROTO_TCP, unix.TCP_CC_INFO); err == nil {
+			congestion.Bbr = &BBRInfo{
+				Bw:         uint64(raw.Bw_hi)<<32 | uint64(raw.Bw_lo),
+				MinRttUs:   raw.Min_rtt,
+				PacingGain: raw.Pacing_gain,
+				CwndGain:   raw.Cwnd_gain,
+			}
+		}
+	case "dctcp":
+		if raw, err := unix.GetsockoptTCPCCDCTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_CC_INFO); err == nil {
+			congestion.Dctcp = &DCTCPInfo{
+				Enabled: raw.Enabled != 0,
+				CeState: raw.Ce_state,
+				Alpha:   raw.Alpha,
+				AbEcn:   raw.Ab_ecn,
+				AbTot:   raw.Ab_tot,
+			}
 		}
-		defer file.Close()
-
-		info, err := unix.GetsockoptTCPInfo(int(file.Fd()), unix.IPPROTO_TCP, unix.TCP_INFO)
-		if err != nil {
-			log.Printf("Error getting TCP info: %v", err)
-			return nil, err
-		} else {
-			return info, nil
+	case "vegas":
+		if raw, err := unix.GetsockoptTCPCCVegasInfo(fd, unix.IPPROTO_TCP, unix.TCP_CC_INFO); err == nil {
+			congestion.Vegas = &VegasInfo{
+				Enabled:  raw.Enabled != 0,
+				RttCnt:   raw.Rttcnt,
+				RttUs:    raw.Rtt,
+				MinRttUs: raw.Minrtt,
+			}
 		}
 	}
-	return nil, errors.New("no tcp conn")
+	return congestion
+}
+
+func newInfo(raw *LinuxTCPInfo) *Info {
+	state, ok := linuxStates[raw.State]
+	if !ok {
+		state = StateUnknown
+	}
+	var unsupported []string
+	for _, source := range normalizedSources {
+		if !raw.Has(source.raw) {
+			unsupported = append(unsupported, source.name)
+		}
+	}
+	return &Info{
+		State:        state,
+		Mss:          raw.Snd_mss,
+		RttUs:        raw.Rtt,
+		MinRttUs:     raw.Min_rtt,
+		Cwnd:         raw.Snd_cwnd * raw.Snd_mss,
+		SndWnd:       raw.Snd_wnd,
+		RcvWnd:       raw.Rcv_wnd,
+		BytesIn:      raw.Bytes_received,
+		BytesOut:     raw.Bytes_sent,
+		BytesAcked:   raw.Bytes_acked,
+		BytesRetrans: raw.Bytes_retrans,
+		Retransmits:  raw.Total_retrans,
+		RcvSpace:     raw.Rcv_space,
+		DeliveryRate: raw.Delivery_rate,
+		NotsentBytes: raw.Notsent_bytes,
+
+		BytesInFlight:   raw.Unacked * raw.Snd_mss,
+		Pmtu:            raw.Pmtu,
+		BusyTimeUs:      raw.Busy_time,
+		RwndLimitedUs:   raw.Rwnd_limited,
+		SndbufLimitedUs: raw.Sndbuf_limited,
+		Timeouts:        uint32(raw.Total_rto),
+		ReordSeen:       raw.Reord_seen,
+		DsackDups:       raw.Dsack_dups,
+
+		Unsupported: unsupported,
+		Raw:         raw,
+	}
 }
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"syscall"
 	"unsafe"
 )
@@ -34,47 +35,99 @@ const (
 	SIO_TCP_INFO = syscall.IOC_INOUT | syscall.IOC_VENDOR | 39
 )
 
-func GetTcpInfo(conn net.Conn) (*TCPInfoV0, error) {
-	// Get TCP info before closing
-	if tcpConn, ok := conn.(*net.TCPConn); ok {
-		rawConn, err := tcpConn.SyscallConn()
-		if err != nil {
-			return nil, fmt.Errorf("failed to get syscall conn: %w", err)
-		}
+// TCPSTATE enumeration values used by TCP_INFO_v0.State
+var windowsStates = map[uint32]State{
+	0:  StateClose,
+	1:  StateListen,
+	2:  StateSynSent,
+	3:  StateSynRecv,
+	4:  StateEstablished,
+	5:  StateFinWait1,
+	6:  StateFinWait2,
+	7:  StateCloseWait,
+	8:  StateClosing,
+	9:  StateLastAck,
+	10: StateTimeWait,
+}
+
+// windowsUnsupported lists the Info fields that TCP_INFO_v0 has no source for.
+var windowsUnsupported = []string{
+	"bytesAcked",
+	"deliveryRate",
+	"notsentBytes",
+	"pmtu",
+	"busyTime",
+	"rwndLimited",
+	"sndbufLimited",
+	"reordSeen",
+	"dsackDups",
+}
 
-		var info TCPInfoV0
-		var bytesReturned uint32
-		var infoErr error
+func GetTcpInfo(conn net.Conn) (*Info, error) {
+	rawConn, err := SyscallConn(conn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get syscall conn: %w", err)
+	}
 
-		inbuf := uint32(0)
+	var info TCPInfoV0
+	var bytesReturned uint32
+	var infoErr error
 
-		err = rawConn.Control(func(fd uintptr) {
-			// Windows에서 WSAIoctl을 사용하여 TCP_INFO_v0 정보를 가져옴
-			infoErr = syscall.WSAIoctl(
-				syscall.Handle(fd),
-				SIO_TCP_INFO,
-				(*byte)(unsafe.Pointer(&inbuf)),
-				uint32(unsafe.Sizeof(inbuf)),
-				(*byte)(unsafe.Pointer(&info)),
-				uint32(unsafe.Sizeof(info)),
-				&bytesReturned,
-				nil,
-				0,
-			)
-		})
+	inbuf := uint32(0)
 
-		if err != nil {
-			return nil, fmt.Errorf("control function error: %w", err)
-		}
+	err = rawConn.Control(func(fd uintptr) {
+		// Windows에서 WSAIoctl을 사용하여 TCP_INFO_v0 정보를 가져옴
+		infoErr = syscall.WSAIoctl(
+			syscall.Handle(fd),
+			SIO_TCP_INFO,
+			(*byte)(unsafe.Pointer(&inbuf)),
+			uint32(unsafe.Sizeof(inbuf)),
+			(*byte)(unsafe.Pointer(&info)),
+			uint32(unsafe.Sizeof(info)),
+			&bytesReturned,
+			nil,
+			0,
+		)
+	})
 
-		if infoErr != nil {
-			var errno syscall.Errno
-			errors.As(infoErr, &errno)
-			return nil, fmt.Errorf("WSAIoctl error: %d, %w", errno, infoErr)
-		}
+	if err != nil {
+		return nil, fmt.Errorf("control function error: %w", err)
+	}
 
-		return &info, nil
+	if infoErr != nil {
+		var errno syscall.Errno
+		errors.As(infoErr, &errno)
+		return nil, fmt.Errorf("WSAIoctl error: %d, %w", errno, infoErr)
 	}
 
-	return nil, errors.New("no tcp conn")
+	return newInfo(&info), nil
+}
+
+func newInfo(raw *TCPInfoV0) *Info {
+	state, ok := windowsStates[raw.State]
+	if !ok {
+		state = StateUnknown
+	}
+	return &Info{
+		State:        state,
+		Mss:          raw.Mss,
+		RttUs:        raw.RttUs,
+		MinRttUs:     raw.MinRttUs,
+		Cwnd:         raw.Cwnd,
+		SndWnd:       raw.SndWnd,
+		RcvWnd:       raw.RcvWnd,
+		BytesIn:      raw.BytesIn,
+		BytesOut:     raw.BytesOut,
+		BytesRetrans: uint64(raw.BytesRetrans),
+		// Windows only counts retransmission episodes, not segments
+		Retransmits: raw.FastRetrans + raw.TimeoutEpisodes,
+		RcvSpace:    raw.RcvBuf,
+
+		BytesInFlight: raw.BytesInFlight,
+		Timeouts:      raw.TimeoutEpisodes,
+
+		// every Info gets its own copy so that callers may modify it
+		Unsupported: slices.Clone(windowsUnsupported),
+		Raw:         raw,
+	}
 }
@@ -0,0 +1,80 @@
+// Package udpprobe is the datagram format of the constant rate UDP test.
+//
+// The client sends Data packets carrying a sequence number and its send
+// time at the target rate, then repeats an End packet until the server
+// answers with a Result packet holding its result JSON. Every packet starts
+// with a fixed header:
+//
+//	magic "TSPU" | version (1) | type (1) | reserved (2) | session (8) | seq (8) | send time (8)
+//
+// Integers are big endian. The session is chosen by the client to tell
+// tests from the same address apart.
+package udpprobe
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	Magic   = "TSPU"
+	Version = 1
+
+	HeaderSize = 32
+	// DefaultPacketSize fits in the MTU of almost every path, like the
+	// initial packets of QUIC.
+	DefaultPacketSize = 1200
+	// MaxPacketSize is the largest UDP payload over IPv4.
+	MaxPacketSize = 65507
+	// EndSize is the size End packets are padded to. The server never
+	// answers with a larger Result, so a spoofed source address gains no
+	// amplification.
+	EndSize = 1200
+)
+
+var ErrInvalid = errors.New("not a probe packet")
+
+type Type uint8
+
+const (
+	TypeData   Type = 1
+	TypeEnd    Type = 2
+	TypeResult Type = 3
+)
+
+// Header starts every packet. Seq of an End packet is the number of Data
+// packets sent. SendTime is in nanoseconds on the clock of the client, only
+// differences between packets are meaningful.
+type Header struct {
+	Type     Type
+	Session  uint64
+	Seq      uint64
+	SendTime int64
+}
+
+// Encode writes the header to the first HeaderSize bytes of buf.
+func (h *Header) Encode(buf []byte) {
+	copy(buf[0:4], Magic)
+	buf[4] = Version
+	buf[5] = byte(h.Type)
+	buf[6], buf[7] = 0, 0
+	binary.BigEndian.PutUint64(buf[8:16], h.Session)
+	binary.BigEndian.PutUint64(buf[16:24], h.Seq)
+	binary.BigEndian.PutUint64(buf[24:32], uint64(h.SendTime))
+}
+
+func Decode(buf []byte) (*Header, error) {
+	if len(buf) < HeaderSize || string(buf[0:4]) != Magic {
+		return nil, ErrInvalid
+	}
+	if buf[4] != Version {
+		return nil, fmt.Errorf("unsupported probe version %d", buf[4])
+	}
+	return &Header{
+		Type:     Type(buf[5]),
+		Session:  binary.BigEndian.Uint64(buf[8:16]),
+		Seq:      binary.BigEndian.Uint64(buf[16:24]),
+		SendTime: int64(binary.BigEndian.Uint64(buf[24:32])),
+	}, nil
+}
@@ -0,0 +1,33 @@
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var rateSuffixes = map[byte]float64{'K': 1e3, 'M': 1e6, 'G': 1e9, 'T': 1e12}
+
+// ParseBitrate parses a bitrate in bits/sec such as "500k", "100M" or
+// "1.5Gbps". Unlike sizes, rates use decimal units.
+func ParseBitrate(s string) (float64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	upper = strings.TrimSuffix(upper, "BPS")
+
+	unit := 1.0
+	if n := len(upper); n > 0 {
+		if u, ok := rateSuffixes[upper[n-1]]; ok {
+			unit = u
+			upper = upper[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(upper, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid bitrate %q", s)
+	}
+	if f <= 0 || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, fmt.Errorf("bitrate %q must be positive", s)
+	}
+	return f * unit, nil
+}
@@ -0,0 +1,58 @@
+// Package units parses the human readable sizes used by test parameters.
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	KiB int64 = 1 << 10
+	MiB int64 = 1 << 20
+	GiB int64 = 1 << 30
+	TiB int64 = 1 << 40
+)
+
+var suffixes = map[byte]int64{'K': KiB, 'M': MiB, 'G': GiB, 'T': TiB}
+
+// ParseSize parses a size such as "512K", "10M", "1.5G", "2GiB" or "100B".
+// Units are binary and a trailing "B" or "iB" is optional. A number without
+// any unit is multiplied by defaultUnit.
+func ParseSize(s string, defaultUnit int64) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+
+	unit := defaultUnit
+	if strings.HasSuffix(upper, "B") {
+		unit = 1
+		upper = strings.TrimSuffix(strings.TrimSuffix(upper, "IB"), "B")
+	}
+	if n := len(upper); n > 0 {
+		if u, ok := suffixes[upper[n-1]]; ok {
+			unit = u
+			upper = upper[:n-1]
+		}
+	}
+
+	if n, err := strconv.ParseInt(upper, 10, 64); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("negative size %q", s)
+		}
+		if n > math.MaxInt64/unit {
+			return 0, fmt.Errorf("size %q overflows", s)
+		}
+		return n * unit, nil
+	}
+	f, err := strconv.ParseFloat(upper, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if f < 0 || math.IsNaN(f) {
+		return 0, fmt.Errorf("negative size %q", s)
+	}
+	if f*float64(unit) >= math.MaxInt64 {
+		return 0, fmt.Errorf("size %q overflows", s)
+	}
+	return int64(f * float64(unit)), nil
+}
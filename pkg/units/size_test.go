@@ -0,0 +1,79 @@
+package units
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in          string
+		defaultUnit int64
+		want        int64
+	}{
+		{"0", MiB, 0},
+		{"16", MiB, 16 * MiB},
+		{"16", 1, 16},
+		{"100B", MiB, 100},
+		{"512K", 1, 512 * KiB},
+		{"512k", 1, 512 * KiB},
+		{"512KB", 1, 512 * KiB},
+		{"512KiB", 1, 512 * KiB},
+		{"10M", 1, 10 * MiB},
+		{"2GiB", 1, 2 * GiB},
+		{"1T", 1, TiB},
+		{"1.5G", 1, 3 * GiB / 2},
+		{" 64M ", 1, 64 * MiB},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in, tt.defaultUnit)
+		if err != nil {
+			t.Errorf("ParseSize(%q): %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseSize(%q, %d) = %d, want %d", tt.in, tt.defaultUnit, got, tt.want)
+		}
+	}
+}
+
+func TestParseSizeErrors(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"M",
+		"abc",
+		"8E",
+		"-1",
+		"-1M",
+		"-0.5K",
+		"NaN",
+		"9223372036854775807K",
+		"8388608T",
+		"1e30",
+	} {
+		if got, err := ParseSize(in, 1); err == nil {
+			t.Errorf("ParseSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+	}{
+		{"1000", 1000},
+		{"500k", 500e3},
+		{"100M", 100e6},
+		{"1.5Gbps", 1.5e9},
+		{"10mbps", 10e6},
+	}
+	for _, tt := range tests {
+		got, err := ParseBitrate(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseBitrate(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "0", "-1M", "fast", "Inf"} {
+		if got, err := ParseBitrate(in); err == nil {
+			t.Errorf("ParseBitrate(%q) = %v, want an error", in, got)
+		}
+	}
+}